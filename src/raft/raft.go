@@ -98,6 +98,14 @@ type Raft struct {
 	nextIndex  []int // for each server, index of the next log entry to send to that server
 	matchIndex []int // for each server, index of highest log entry known to be replicated on server
 
+	// leaseUntil is how long this peer, while a follower, trusts that no
+	// other leader can yet have been elected for currentTerm or later: it is
+	// pushed forward by electionTimeBase every time an AppendEntries from
+	// the current leader is accepted, and electionTimeBase is the shortest
+	// possible time a follower can go without hearing from a leader before
+	// timing out and starting its own election. See ReadIndex.
+	leaseUntil time.Time
+
 	// Channels
 	heartbeat      chan bool          // signal indicates leader is alive
 	grantVote      chan bool          // signal indicates electing leader
@@ -122,6 +130,26 @@ func (rf *Raft) GetState() (int, bool) {
 	return term, isleader
 }
 
+// ReadIndex returns a log index the caller may read the state machine at,
+// together with whether this peer is currently trusted to serve it: either
+// it is the leader, or it is a follower whose lease on the current term
+// has not yet expired (see leaseUntil), meaning no other leader can yet
+// have been elected. The caller still must wait for its own lastApplied to
+// reach the returned index before answering with local state, and must
+// still check that it continues to own whatever shard/key is being read.
+func (rf *Raft) ReadIndex() (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.currentState == leader {
+		return rf.commitIndex, true
+	}
+	if rf.currentState == follower && time.Now().Before(rf.leaseUntil) {
+		return rf.commitIndex, true
+	}
+	return 0, false
+}
+
 // save Raft's persistent state to stable storage,
 // where it can later be retrieved after a crash and restart.
 // see paper's Figure 2 for a description of what should be persistent.
@@ -481,6 +509,7 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 		reply.Term = rf.currentTerm
 		rf.votedFor = args.CandidateId
 		rf.persist(nil)
+		rf.leaseUntil = time.Time{} // voting for someone else means our old leader's lease no longer holds
 
 		signalCh(rf.grantVote, true)
 	} else { // candidate's log is outdated
@@ -673,6 +702,7 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 		}
 		reply.Success = true
 		reply.Term = rf.currentTerm
+		rf.leaseUntil = time.Now().Add(electionTimeBase * time.Millisecond)
 	}
 
 }
@@ -731,6 +761,11 @@ func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *Ap
 		if rf.tryCommit(server) {
 			// apply log
 			signalCh(rf.applyTrigger, true)
+			// let followers learn the new commitIndex right away instead of
+			// waiting for the next heartbeat, so a follower lease read (see
+			// ReadIndex) isn't left trusting a stale commitIndex any longer
+			// than this round trip takes.
+			signalCh(rf.startAgreement, true)
 		}
 
 		if reply.XLen < rf.lastIncludedIndex+1 {
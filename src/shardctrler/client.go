@@ -54,11 +54,33 @@ func (ck *Clerk) Query(num int) Config {
 }
 
 func (ck *Clerk) Join(servers map[int][]string) {
+	ck.join(servers, nil, nil)
+}
+
+// JoinWeighted is like Join, but also assigns weights to the groups being
+// added, so shard() gives them shards proportional to weight instead of
+// splitting evenly. A group with no entry here (or a non-positive one)
+// gets the default weight of 1; SetWeight can change it again later.
+func (ck *Clerk) JoinWeighted(servers map[int][]string, weights map[int]int) {
+	ck.join(servers, weights, nil)
+}
+
+// JoinWithPlacement is like Join, but also records each group's zone/rack,
+// for shard()'s placement policy (see the shard() doc comment). A group
+// with no entry here has unknown placement; SetPlacement can set or change
+// it again later.
+func (ck *Clerk) JoinWithPlacement(servers map[int][]string, placements map[int]Placement) {
+	ck.join(servers, nil, placements)
+}
+
+func (ck *Clerk) join(servers map[int][]string, weights map[int]int, placements map[int]Placement) {
 	ck.SN++
 	args := &JoinArgs{
 		ClientId: ck.clientId,
 		SN: ck.SN,
 		Servers: servers,
+		Weights: weights,
+		Placements: placements,
 	}
 
 	for {
@@ -74,6 +96,56 @@ func (ck *Clerk) Join(servers map[int][]string) {
 	}
 }
 
+// SetWeight changes gid's weight for proportional sharding and triggers an
+// immediate rebalance under it, the same as Join/Leave do. weight <= 0
+// clears any override, returning gid to the default weight of 1.
+func (ck *Clerk) SetWeight(gid int, weight int) {
+	ck.SN++
+	args := &SetWeightArgs{
+		ClientId: ck.clientId,
+		SN: ck.SN,
+		GID: gid,
+		Weight: weight,
+	}
+
+	for {
+		// try each known server.
+		for _, srv := range ck.servers {
+			var reply SetWeightReply
+			ok := srv.Call("ShardCtrler.SetWeight", args, &reply)
+			if ok && reply.Err != ErrWrongLeader {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// SetPlacement records gid's zone/rack, for shard()'s placement policy (see
+// the shard() doc comment). Unlike SetWeight this does not itself trigger a
+// rebalance.
+func (ck *Clerk) SetPlacement(gid int, placement Placement) {
+	ck.SN++
+	args := &SetPlacementArgs{
+		ClientId: ck.clientId,
+		SN: ck.SN,
+		GID: gid,
+		Placement: placement,
+	}
+
+	for {
+		// try each known server.
+		for _, srv := range ck.servers {
+			var reply SetPlacementReply
+			ok := srv.Call("ShardCtrler.SetPlacement", args, &reply)
+			if ok && reply.Err != ErrWrongLeader {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func (ck *Clerk) Leave(gids []int) {
 	ck.SN++
 	args := &LeaveArgs{
@@ -95,6 +167,179 @@ func (ck *Clerk) Leave(gids []int) {
 	}
 }
 
+// ReportLoad hands the shardctrler this group's latest per-shard load
+// estimate. Unlike Join/Leave/Move/Query it carries no serial number and
+// makes only a best-effort attempt: a stale or dropped report is simply
+// superseded by the next periodic one, so there is nothing worth blocking
+// the caller to retry.
+func (ck *Clerk) ReportLoad(gid int, loads [NShards]int) {
+	args := &ReportLoadArgs{
+		GID:   gid,
+		Loads: loads,
+	}
+
+	for _, srv := range ck.servers {
+		var reply ReportLoadReply
+		ok := srv.Call("ShardCtrler.ReportLoad", args, &reply)
+		if ok && reply.Err == OK {
+			return
+		}
+	}
+}
+
+// AckConfig tells the shardctrler the oldest Config num this group still
+// needs, so its configGC can discard anything older. Like ReportLoad it
+// carries no serial number and makes only a best-effort attempt: a stale
+// or dropped ack just delays compaction a little, never causes it.
+func (ck *Clerk) AckConfig(gid int, num int) {
+	args := &AckConfigArgs{
+		GID: gid,
+		Num: num,
+	}
+
+	for _, srv := range ck.servers {
+		var reply AckConfigReply
+		ok := srv.Call("ShardCtrler.AckConfig", args, &reply)
+		if ok && reply.Err == OK {
+			return
+		}
+	}
+}
+
+// QueryRange fetches every config numbered between from and to (inclusive)
+// in a single RPC, trying each known server until one answers, for a
+// caller catching up on missed configs without one Query per number. to ==
+// -1 means "up to whatever is latest". See the QueryRange RPC's doc
+// comment for why this doesn't go through raft.
+func (ck *Clerk) QueryRange(from int, to int) []Config {
+	args := &QueryRangeArgs{From: from, To: to}
+
+	for _, srv := range ck.servers {
+		var reply QueryRangeReply
+		ok := srv.Call("ShardCtrler.QueryRange", args, &reply)
+		if ok && reply.Err == OK {
+			return reply.Configs
+		}
+	}
+	return nil
+}
+
+// QueryLatestN fetches the N most recent configs in a single RPC, oldest
+// first, trying each known server until one answers.
+func (ck *Clerk) QueryLatestN(n int) []Config {
+	args := &QueryLatestNArgs{N: n}
+
+	for _, srv := range ck.servers {
+		var reply QueryLatestNReply
+		ok := srv.Call("ShardCtrler.QueryLatestN", args, &reply)
+		if ok && reply.Err == OK {
+			return reply.Configs
+		}
+	}
+	return nil
+}
+
+// WaitForConfig long-polls for a config newer than num, trying each known
+// server once. It returns the config it received, or Config{Num: num}
+// unchanged if no server answered in time, in which case the caller should
+// just call it again. Unlike Query it never blocks forever: there is
+// nothing time-sensitive about learning of a config change a little late.
+func (ck *Clerk) WaitForConfig(num int) Config {
+	args := &WaitForConfigArgs{Num: num}
+
+	for _, srv := range ck.servers {
+		var reply WaitForConfigReply
+		ok := srv.Call("ShardCtrler.WaitForConfig", args, &reply)
+		if ok && reply.Err == OK {
+			return reply.Config
+		}
+	}
+	return Config{Num: num}
+}
+
+// Drain marks gids for removal: the shardctrler moves their shards to the
+// remaining groups but keeps them addressable until Leave actually removes
+// them. See Decommission for the full drain/wait/leave workflow.
+func (ck *Clerk) Drain(gids []int) {
+	ck.SN++
+	args := &DrainArgs{
+		ClientId: ck.clientId,
+		SN: ck.SN,
+		GIDs: gids,
+	}
+
+	for {
+		// try each known server.
+		for _, srv := range ck.servers {
+			var reply DrainReply
+			ok := srv.Call("ShardCtrler.Drain", args, &reply)
+			if ok && reply.Err != ErrWrongLeader {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// ReportDrained is called by a group, not an admin: it hands the
+// shardctrler the group's own view of whether it currently owns no shards
+// and has nothing left in flight.
+func (ck *Clerk) ReportDrained(gid int, drained bool) {
+	args := &DrainedArgs{GID: gid, Drained: drained}
+
+	for _, srv := range ck.servers {
+		var reply DrainedReply
+		ok := srv.Call("ShardCtrler.ReportDrained", args, &reply)
+		if ok && reply.Err == OK {
+			return
+		}
+	}
+}
+
+// WaitForDrain blocks until gid owns no shards in the current config and
+// has self-reported (via ReportDrained) that it has nothing left in
+// flight. It is meant to run between Drain and Leave in a decommission
+// workflow; see Decommission.
+func (ck *Clerk) WaitForDrain(gid int) {
+	for {
+		cfg := ck.Query(-1)
+		stillOwns := false
+		for _, g := range cfg.Shards {
+			if g == gid {
+				stillOwns = true
+				break
+			}
+		}
+
+		if !stillOwns {
+			args := &QueryDrainedArgs{GID: gid}
+			drained := false
+			for _, srv := range ck.servers {
+				var reply QueryDrainedReply
+				if srv.Call("ShardCtrler.QueryDrained", args, &reply) {
+					drained = reply.Drained
+					break
+				}
+			}
+			if drained {
+				return
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Decommission drains gid, waits for it to confirm it has handed off
+// everything it owned, then finalizes its removal with Leave. This is the
+// safe alternative to calling Leave directly, which can race with shard
+// migrations still in flight out of gid.
+func (ck *Clerk) Decommission(gid int) {
+	ck.Drain([]int{gid})
+	ck.WaitForDrain(gid)
+	ck.Leave([]int{gid})
+}
+
 func (ck *Clerk) Move(shard int, gid int) {
 	ck.SN++
 	args := &MoveArgs{
@@ -18,6 +18,25 @@ package shardctrler
 //
 
 // The number of shards.
+//
+// NShards is fixed rather than dynamic: every group derives a key's shard
+// with client.go's key2shard, which is explicitly pinned ("please do not
+// change it") and every group in the cluster must compute it the same way
+// for migration and routing to agree on who owns what. Splitting a shard's
+// hash space in two, or merging two shards back together, would mean two
+// different key2shard definitions coexisting across a config change, which
+// this fixed, cluster-wide function can't express. Rebalancing cold or hot
+// shards across groups (see shard(), Drain/Decommission) is the supported
+// way to redistribute load instead.
+//
+// It is also a compile-time constant rather than a runtime Config field for
+// the same reason: Config.Shards is declared [NShards]int, a fixed-size
+// array, and Config is itself pinned ("please don't change this"). Making
+// the shard count configurable would mean either changing that array's size
+// per-cluster (not expressible in Go without recompiling) or replacing it
+// with a slice (which changes Config's wire format and every consumer that
+// ranges over Shards by the constant, in both shardctrler and shardkv).
+// Either way touches the one struct this package has been told not to.
 const NShards = 10
 
 // A configuration -- an assignment of shards to groups.
@@ -31,15 +50,19 @@ type Config struct {
 const (
 	OK = "OK"
 	ErrWrongLeader = "ErrWrongLeader"
+	ErrCompacted = "ErrCompacted" // the requested Config is older than every Config this server retained
 	ResponseTimeout = 1000
+	WaitForConfigTimeout = 2000 // how long WaitForConfig blocks before returning the unchanged config
 )
 
 type Err string
 
 type JoinArgs struct {
-	ClientId int64 
-	SN int 
+	ClientId int64
+	SN int
 	Servers map[int][]string // new GID -> servers mappings
+	Weights map[int]int // new GID -> weight for proportional sharding; a missing or non-positive entry defaults to 1
+	Placements map[int]Placement // new GID -> zone/rack, for shard()'s placement policy; a missing entry means "unknown"
 }
 
 type JoinReply struct {
@@ -68,7 +91,7 @@ type MoveReply struct {
 }
 
 type QueryArgs struct {
-	ClientId int64 
+	ClientId int64
 	SN int
 	Num int // desired config number
 }
@@ -78,4 +101,198 @@ type QueryReply struct {
 	Config      Config
 }
 
+// ReportLoad lets a replica group hand the shardctrler a hint about how busy
+// each of its shards is, so future rebalancing decisions can account for
+// skew instead of only shard counts. It is advisory: the report is not
+// replicated through raft, so it reflects whichever server most recently
+// heard from the group's leader.
+type ReportLoadArgs struct {
+	GID   int
+	Loads [NShards]int // per-shard load estimate, as seen by the reporting group
+}
+
+type ReportLoadReply struct {
+	Err Err
+}
+
+// QueryRange fetches every retained Config numbered between From and To
+// (inclusive) in one RPC, for a group that fell behind and would otherwise
+// need one Query per missing config to catch up. To == -1 means "up to
+// whatever is latest". It is served directly off whichever replica answers,
+// without going through raft (see the QueryRange RPC's doc comment), so the
+// result can start later than From if older configs were compacted away, or
+// end before To if they haven't been created yet.
+type QueryRangeArgs struct {
+	From int
+	To   int
+}
+
+type QueryRangeReply struct {
+	Err     Err
+	Configs []Config // From..To clamped to what's retained/exists, oldest first
+}
+
+// QueryLatestN fetches the N most recent Configs in one RPC, oldest first.
+// Like QueryRange this is served directly off whichever replica answers,
+// without going through raft.
+type QueryLatestNArgs struct {
+	N int
+}
+
+type QueryLatestNReply struct {
+	Err     Err
+	Configs []Config // up to N most recent, oldest first; fewer than N if that many don't exist yet
+}
+
+// WaitForConfig lets a caller long-poll for the next configuration instead
+// of repeatedly calling Query and comparing numbers. The shardctrler blocks
+// the RPC until a config newer than Num is applied, or WaitForConfigTimeout
+// elapses, whichever comes first, then replies with whatever is current.
+// This is the cluster's watch-for-config-change primitive: shardkv's
+// configWatcher already calls it in a loop to turn what would otherwise be
+// constant Query polling into one outstanding long-poll per group (see
+// configWatcher's doc comment), so a separately named Watch RPC would just
+// be this one under another name.
+type WaitForConfigArgs struct {
+	Num int // caller's last known config number
+}
+
+type WaitForConfigReply struct {
+	Err    Err
+	Config Config
+}
+
+// Drain marks gids for removal without actually deleting them from the
+// current config's Groups: the shardctrler reassigns all of their shards
+// to the remaining groups, exactly like Leave would, but leaves the
+// draining groups addressable so they can keep serving migrations and
+// warmup pulls of the shards they're handing off. Call Leave to actually
+// remove a gid once WaitForDrain confirms it owns nothing anymore.
+type DrainArgs struct {
+	ClientId int64
+	SN int
+	GIDs []int
+}
+
+type DrainReply struct {
+	Err Err
+}
+
+// DrainedArgs/DrainedReply back the group side of a drain: a group reports
+// whether it currently owns no shards and has nothing in flight, so a
+// caller driving Decommission can tell the difference between "reassigned
+// in the config" and "actually finished handing the data off." Advisory,
+// like ReportLoad: not replicated through raft.
+type DrainedArgs struct {
+	GID     int
+	Drained bool
+}
+
+type DrainedReply struct {
+	Err Err
+}
+
+type QueryDrainedArgs struct {
+	GID int
+}
+
+type QueryDrainedReply struct {
+	Drained bool
+}
+
+// SetWeight changes gid's weight for proportional sharding and triggers an
+// immediate rebalance under it, the same as Join/Leave do. Weight <= 0
+// clears any override, returning gid to the default weight of 1.
+type SetWeightArgs struct {
+	ClientId int64
+	SN int
+	GID    int
+	Weight int
+}
+
+type SetWeightReply struct {
+	Err Err
+}
+
+// Placement is a group's failure-domain location: which zone it's in, and
+// which rack within that zone. Either field may be left empty if unknown;
+// shard()'s placement policy treats an empty field as never clashing with
+// anything, so partial placement data degrades gracefully instead of
+// skewing the result.
+type Placement struct {
+	Zone string
+	Rack string
+}
+
+// SetPlacement records gid's zone/rack, for shard()'s placement policy (see
+// the shard() doc comment). Unlike SetWeight this is pure metadata: it does
+// not itself trigger a rebalance, since it can't improve the spread of
+// shards the group already holds, only influence which group a shard
+// freed by a later Join/Leave/Drain/SetWeight lands on.
+type SetPlacementArgs struct {
+	ClientId int64
+	SN int
+	GID       int
+	Placement Placement
+}
 
+type SetPlacementReply struct {
+	Err Err
+}
+
+// PlacementMode selects which algorithm shard() uses to assign shards to
+// groups.
+type PlacementMode string
+
+const (
+	// PlacementModeBalanced is the default: proportionally balanced by
+	// weight and, subject to that, minimal-movement from the previous
+	// config (see the shard() doc comment).
+	PlacementModeBalanced PlacementMode = ""
+
+	// PlacementModeConsistentHash assigns shards via a consistent-hash
+	// ring over gids instead: every shard and every (gid, vnode) pair
+	// hashes onto the same ring independent of any previous config, so a
+	// Join or Leave only remaps the shards that hashed nearest the
+	// gid(s) that changed, and a restarted controller with the same
+	// group membership always recomputes the same assignment without
+	// needing its config history at all. The tradeoff is balance: with
+	// only NShards points to place, the ring can leave a group with
+	// noticeably more or fewer than its proportional share, where
+	// PlacementModeBalanced would have kept everyone within one shard of
+	// quota.
+	PlacementModeConsistentHash PlacementMode = "consistenthash"
+)
+
+// ShardCtrlerConfig holds StartServer options that don't belong on Config
+// (which is pinned) and aren't replicated: every replica is started with
+// the same value, so there is nothing to agree on through raft.
+type ShardCtrlerConfig struct {
+	Mode PlacementMode
+	ConfigGCInterval int // ms, how often the leader proposes a Config history compaction pass
+}
+
+func DefaultShardCtrlerConfig() ShardCtrlerConfig {
+	return ShardCtrlerConfig{Mode: PlacementModeBalanced, ConfigGCInterval: ConfigGCInterval}
+}
+
+const ConfigGCInterval = 2000 // how often the leader proposes a Config history compaction pass
+
+// AckConfig lets a replica group tell the controller the oldest Config Num
+// it might still need, so the controller knows it's safe to discard
+// anything older. Like ReportLoad/ReportDrained this is advisory and
+// outside raft: a stale or dropped ack only delays compaction, never
+// causes it to discard something a live group still needs, since the
+// compaction pass itself only ever uses the minimum Num acked across every
+// group currently in Groups (see the shardctrler package's Compact
+// support), and a group that hasn't acked yet counts as needing
+// everything. Acking a number you might still need cannot be undone,
+// though: ack conservatively, not eagerly.
+type AckConfigArgs struct {
+	GID int
+	Num int
+}
+
+type AckConfigReply struct {
+	Err Err
+}
@@ -1,9 +1,13 @@
 package shardctrler
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
 	"log"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"6.5840/labgob"
@@ -21,12 +25,17 @@ func DPrintf(format string, a ...interface{}) (n int, err error) {
 }
 
 type Op struct {
-	Type string // "Join", "Leave", "Move" or "Query"
+	Type string // "Join", "Leave", "Move", "Query", "Drain", "SetWeight", "SetPlacement" or "CompactConfigs"
 	Servers map[int][]string // Join arg
-	GIDs []int // Leave arg
+	Weights map[int]int // Join arg, optional
+	Placements map[int]Placement // Join arg, optional
+	GIDs []int // Leave/Drain arg
 	Shard int // Move arg
-	GID   int // Move arg
+	GID   int // Move/SetWeight/SetPlacement arg
+	Weight int // SetWeight arg
+	Placement Placement // SetPlacement arg
 	Num int // Query arg
+	CompactBefore int // CompactConfigs arg: discard configs older than this Num
 	ClientId int64 // who assigns this Op
 	SN int // serial number for this Op
 }
@@ -60,6 +69,18 @@ type ShardCtrler struct {
 	// Volatile state on all server.
 	resultCh map[int]chan doitResult // transfer result to RPC
 	lastApplied int // lastApplied log index
+	loads map[int][NShards]int // gid -> per-shard load, as last reported; advisory only, not replicated
+	configCh chan struct{} // closed and replaced each time a new config is applied, to wake WaitForConfig
+	draining map[int]bool // gid -> pending removal, replicated via the "Drain" op
+	drained  map[int]bool // gid -> group's own report that it owns nothing and has nothing in flight; advisory only
+	weights  map[int]int  // gid -> weight for proportional sharding, replicated via "Join"/"SetWeight"; a missing entry means 1
+	placements map[int]Placement // gid -> zone/rack, replicated via "Join"/"SetPlacement"; a missing entry means unknown
+	acked    map[int]int  // gid -> oldest Config Num it last acked needing, via AckConfig; advisory only
+
+	cfg  ShardCtrlerConfig // tunables; see DefaultShardCtrlerConfig
+	dead int32             // set by Kill()
+	done chan struct{}     // closed by Kill(), to stop configGC
+	doneOnce sync.Once
 }
 
 // handle one Op received by Join, Leave, Move, or Query RPC.
@@ -125,10 +146,49 @@ func (sc *ShardCtrler) Join(args *JoinArgs, reply *JoinReply) {
 	op := Op {
 		Type: "Join",
 		Servers: args.Servers,
+		Weights: args.Weights,
+		Placements: args.Placements,
 		ClientId: args.ClientId,
 		SN: args.SN,
 	}
-	
+
+	result := sc.doit(&op)
+
+	if result.ClientId == args.ClientId && result.SN == args.SN {
+		reply.Err = result.Err
+	}
+}
+
+// SetWeight changes gid's weight for proportional sharding and immediately
+// triggers a rebalance under it, the same as Join/Leave do.
+func (sc *ShardCtrler) SetWeight(args *SetWeightArgs, reply *SetWeightReply) {
+	op := Op{
+		Type: "SetWeight",
+		GID: args.GID,
+		Weight: args.Weight,
+		ClientId: args.ClientId,
+		SN: args.SN,
+	}
+
+	result := sc.doit(&op)
+
+	if result.ClientId == args.ClientId && result.SN == args.SN {
+		reply.Err = result.Err
+	}
+}
+
+// SetPlacement records gid's zone/rack for shard()'s placement policy. See
+// the SetPlacementArgs doc comment for why this doesn't trigger a rebalance
+// on its own.
+func (sc *ShardCtrler) SetPlacement(args *SetPlacementArgs, reply *SetPlacementReply) {
+	op := Op{
+		Type: "SetPlacement",
+		GID: args.GID,
+		Placement: args.Placement,
+		ClientId: args.ClientId,
+		SN: args.SN,
+	}
+
 	result := sc.doit(&op)
 
 	if result.ClientId == args.ClientId && result.SN == args.SN {
@@ -156,7 +216,26 @@ func (sc *ShardCtrler) Leave(args *LeaveArgs, reply *LeaveReply) {
 	}
 }
 
-// The Move RPC's arguments are a shard number and a GID. 
+// Drain reassigns gids' shards to the remaining groups, like Leave, but
+// keeps them in the config's Groups so they stay addressable while they
+// hand off what they still have. It's the first step of the decommission
+// workflow: Drain, then WaitForDrain, then Leave to actually remove them.
+func (sc *ShardCtrler) Drain(args *DrainArgs, reply *DrainReply) {
+	op := Op {
+		Type: "Drain",
+		GIDs: args.GIDs,
+		ClientId: args.ClientId,
+		SN: args.SN,
+	}
+
+	result := sc.doit(&op)
+
+	if result.ClientId == args.ClientId && result.SN == args.SN {
+		reply.Err = result.Err
+	}
+}
+
+// The Move RPC's arguments are a shard number and a GID.
 // The shardctrler should create a new configuration in which the shard is assigned to the group.
 // The purpose of Move is to allow us to test your software. 
 // A Join or Leave following a Move will likely un-do the Move, since Join and Leave re-balance.
@@ -204,8 +283,13 @@ func (sc *ShardCtrler) Query(args *QueryArgs, reply *QueryReply) {
 // in Kill(), but it might be convenient to (for example)
 // turn off debug output from this instance.
 func (sc *ShardCtrler) Kill() {
+	atomic.StoreInt32(&sc.dead, 1)
 	sc.rf.Kill()
-	// Your code here, if desired.
+	sc.doneOnce.Do(func() { close(sc.done) })
+}
+
+func (sc *ShardCtrler) killed() bool {
+	return atomic.LoadInt32(&sc.dead) == 1
 }
 
 // needed by shardkv tester
@@ -213,13 +297,142 @@ func (sc *ShardCtrler) Raft() *raft.Raft {
 	return sc.rf
 }
 
+// ReportLoad records a replica group's self-reported per-shard load. It is
+// purely advisory and handled outside raft: a rebalancing decision that
+// wants to use it takes its own snapshot at decision time rather than
+// relying on this being consistent across servers.
+func (sc *ShardCtrler) ReportLoad(args *ReportLoadArgs, reply *ReportLoadReply) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.loads[args.GID] = args.Loads
+	reply.Err = OK
+}
+
+// ReportDrained lets a group tell the shardctrler whether it currently
+// owns no shards and has no migration in flight, i.e. it is safe to Leave.
+// Like ReportLoad this is advisory and outside raft: a stale or dropped
+// report just means WaitForDrain waits a little longer, never that it
+// returns an unsafe answer early.
+func (sc *ShardCtrler) ReportDrained(args *DrainedArgs, reply *DrainedReply) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.drained[args.GID] = args.Drained
+	reply.Err = OK
+}
+
+// QueryDrained reports the group's own last self-reported drained state.
+func (sc *ShardCtrler) QueryDrained(args *QueryDrainedArgs, reply *QueryDrainedReply) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	reply.Drained = sc.drained[args.GID]
+}
+
+// AckConfig records a group's self-reported floor on which Configs it
+// still needs, feeding configGC's compaction pass (see the AckConfig
+// type's doc comment). Like ReportLoad/ReportDrained this is advisory and
+// outside raft; unlike them it only ever moves forward, since acking a
+// lower Num than already acked would just be ignored by configGC anyway.
+func (sc *ShardCtrler) AckConfig(args *AckConfigArgs, reply *AckConfigReply) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if args.Num > sc.acked[args.GID] {
+		sc.acked[args.GID] = args.Num
+	}
+	reply.Err = OK
+}
+
+// WaitForConfig blocks until a config newer than args.Num is applied, or
+// WaitForConfigTimeout elapses, then returns the latest config. It is
+// served directly off applied state, without going through raft: the
+// caller only uses it to learn sooner that it should Query, so it does not
+// need Query's linearizability, and blocking inside doit would tie up a
+// raft log slot for no reason. A timed-out call simply returns the
+// unchanged config, which the caller treats the same as "nothing new yet".
+func (sc *ShardCtrler) WaitForConfig(args *WaitForConfigArgs, reply *WaitForConfigReply) {
+	sc.mu.Lock()
+	if sc.configs[len(sc.configs)-1].Num > args.Num {
+		reply.Err = OK
+		reply.Config = sc.configs[len(sc.configs)-1]
+		sc.mu.Unlock()
+		return
+	}
+	ch := sc.configCh
+	sc.mu.Unlock()
+
+	select {
+	case <-ch:
+	case <-time.After(time.Duration(WaitForConfigTimeout) * time.Millisecond):
+	}
+
+	sc.mu.Lock()
+	reply.Err = OK
+	reply.Config = sc.configs[len(sc.configs)-1]
+	sc.mu.Unlock()
+}
+
+// QueryRange answers with every retained config numbered between args.From
+// and args.To (inclusive), or up to the latest if args.To is -1. Like
+// WaitForConfig it is served directly off applied state without going
+// through raft: the configs it returns are already immutable history (only
+// ever trimmed from the front by compaction, never rewritten), so there is
+// nothing to linearize against. A caller that needs the very latest config
+// should follow up with Query(-1).
+func (sc *ShardCtrler) QueryRange(args *QueryRangeArgs, reply *QueryRangeReply) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	base := sc.configs[0].Num
+	latest := sc.configs[len(sc.configs)-1].Num
+
+	from, to := args.From, args.To
+	if from < base {
+		from = base
+	}
+	if to == -1 || to > latest {
+		to = latest
+	}
+	reply.Err = OK
+	if from > to {
+		return
+	}
+	reply.Configs = append([]Config{}, sc.configs[from-base:to-base+1]...)
+}
+
+// QueryLatestN answers with the N most recent retained configs, oldest
+// first. Like QueryRange this is served directly off applied state without
+// going through raft.
+func (sc *ShardCtrler) QueryLatestN(args *QueryLatestNArgs, reply *QueryLatestNReply) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	n := args.N
+	if n > len(sc.configs) {
+		n = len(sc.configs)
+	}
+	if n < 0 {
+		n = 0
+	}
+	reply.Err = OK
+	reply.Configs = append([]Config{}, sc.configs[len(sc.configs)-n:]...)
+}
+
 // servers[] contains the ports of the set of
 // servers that will cooperate via Raft to
 // form the fault-tolerant shardctrler service.
 // me is the index of the current server in servers[].
-func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister) *ShardCtrler {
+//
+// cfgOverride is optional: pass nothing to get DefaultShardCtrlerConfig(),
+// or one ShardCtrlerConfig to pick a different PlacementMode or
+// ConfigGCInterval. Every replica must be started with the same one: it
+// isn't replicated, since it's an algorithm/timing choice, not state to
+// agree on.
+func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister, cfgOverride ...ShardCtrlerConfig) *ShardCtrler {
 	sc := new(ShardCtrler)
 	sc.me = me
+	sc.cfg = DefaultShardCtrlerConfig()
+	if len(cfgOverride) > 0 {
+		sc.cfg = cfgOverride[0]
+	}
 
 	sc.configs = make([]Config, 1)
 	sc.configs[0].Groups = map[int][]string{}
@@ -229,8 +442,17 @@ func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister)
 	sc.rf = raft.Make(servers, me, persister, sc.applyCh)
 	sc.DupTable = make(map[int64]DupEntry)
 	sc.resultCh = make(map[int]chan doitResult)
+	sc.loads = make(map[int][NShards]int)
+	sc.configCh = make(chan struct{})
+	sc.draining = make(map[int]bool)
+	sc.drained = make(map[int]bool)
+	sc.weights = make(map[int]int)
+	sc.placements = make(map[int]Placement)
+	sc.acked = make(map[int]int)
+	sc.done = make(chan struct{})
 
 	go sc.applier(persister)
+	go sc.configGC()
 
 	return sc
 }
@@ -276,21 +498,61 @@ func (sc *ShardCtrler) ingestCommand(index int, command interface{}) {
 			for k, v := range op.Servers { // add new replica groups
 				newConfig.Groups[k] = v
 			}
+			for k, v := range op.Weights { // optional per-gid weight, defaults to 1 if absent
+				if v > 0 {
+					sc.weights[k] = v
+				}
+			}
+			for k, v := range op.Placements { // optional per-gid zone/rack
+				sc.placements[k] = v
+			}
 			sc.configs = append(sc.configs, newConfig)
 			sc.shard()
 		case "Leave":
 			newConfig := sc.createConfig()
 			for _, v := range op.GIDs {
 				delete(newConfig.Groups, v)	// remove replica groups
+				delete(sc.draining, v) // the gid may be reused by a later Join
+				delete(sc.drained, v)
+				delete(sc.weights, v)
+				delete(sc.placements, v)
+				delete(sc.acked, v)
 			}
 			sc.configs = append(sc.configs, newConfig)
 			sc.shard()
+		case "SetWeight":
+			if op.Weight > 0 {
+				sc.weights[op.GID] = op.Weight
+			} else {
+				delete(sc.weights, op.GID) // back to the default weight of 1
+			}
+			newConfig := sc.createConfig()
+			sc.configs = append(sc.configs, newConfig)
+			sc.shard()
+		case "SetPlacement":
+			// metadata only: it can't improve the spread of shards the
+			// group already holds, only influence a future Join/Leave/
+			// Drain/SetWeight's shard() call, so it doesn't append a new
+			// config of its own.
+			sc.placements[op.GID] = op.Placement
+		case "Drain":
+			for _, v := range op.GIDs {
+				sc.draining[v] = true
+			}
+			// keep draining gids in Groups, unlike Leave: shard() below moves
+			// their shards off, but they stay addressable so they can still
+			// serve the migrations and warmup pulls that hand those shards off.
+			newConfig := sc.createConfig()
+			sc.configs = append(sc.configs, newConfig)
+			sc.shard()
 		case "Query":
 			latestNum := sc.configs[len(sc.configs) - 1].Num
 			if op.Num == -1 || op.Num >= latestNum {
 				result.Config = sc.configs[len(sc.configs) - 1]
+			} else if cfg, ok := sc.configAt(op.Num); ok {
+				result.Config = cfg
 			} else {
-				result.Config = sc.configs[op.Num]
+				result.Err = ErrCompacted
 			}
 		case "Move":
 			newConfig := sc.createConfig()
@@ -298,10 +560,29 @@ func (sc *ShardCtrler) ingestCommand(index int, command interface{}) {
 			copy(newConfig.Shards[:], lastConfig.Shards[:])
 			newConfig.Shards[op.Shard] = op.GID
 			sc.configs = append(sc.configs, newConfig)
+		case "CompactConfigs":
+			// cutoff was computed once by configGC's leader and carried in
+			// the Op, so every replica discards exactly the same prefix;
+			// never discard the newest config, there must always be one to
+			// answer Query(-1) with.
+			base := sc.configs[0].Num
+			if op.CompactBefore > base {
+				drop := op.CompactBefore - base
+				if drop > len(sc.configs)-1 {
+					drop = len(sc.configs) - 1
+				}
+				sc.configs = sc.configs[drop:]
+			}
+			return // no new config and no client waiting on this one; nothing to record
 		default:
 			log.Fatal(op)
 		}
 
+		if op.Type != "Query" && op.Type != "SetPlacement" { // a new config was appended; wake anyone long-polling WaitForConfig
+			close(sc.configCh)
+			sc.configCh = make(chan struct{})
+		}
+
 		sc.DupTable[op.ClientId] = DupEntry{ // record the result
 			SN: result.SN,
 			Err: result.Err,
@@ -331,90 +612,300 @@ func (sc *ShardCtrler) createConfig() Config {
 	return newConfig
 }
 
-// shard the new configuration.
-// divide the shards as evenly as possible among the groups, 
-// and move as few shards as possible to achieve that goal.
+// configAt returns the Config numbered num, or ok=false if num is older
+// than every Config this server has retained: some earlier "CompactConfigs"
+// already discarded it. sc.configs is always indexed by num - sc.configs[0].Num,
+// since configs are appended in strictly increasing Num order and only ever
+// trimmed from the front.
+// thread unsafe, need lock.
+func (sc *ShardCtrler) configAt(num int) (Config, bool) {
+	base := sc.configs[0].Num
+	if num < base {
+		return Config{}, false
+	}
+	return sc.configs[num-base], true
+}
+
+// zonesClash reports whether a and b are both known to be in the same
+// non-empty zone. An unknown zone (no Placement recorded for that gid, or
+// gid 0) never clashes with anything.
+func (sc *ShardCtrler) zonesClash(a, b int) bool {
+	pa, ok := sc.placements[a]
+	if !ok || pa.Zone == "" {
+		return false
+	}
+	pb, ok := sc.placements[b]
+	if !ok || pb.Zone == "" {
+		return false
+	}
+	return pa.Zone == pb.Zone
+}
+
+// shard re-derives newConfig.Shards from lastConfig.Shards, called after
+// every Join/Leave/Drain/SetWeight. Under sc.cfg.Mode ==
+// PlacementModeConsistentHash it delegates entirely to
+// shardConsistentHash instead; everything below describes the default,
+// PlacementModeBalanced. It maintains two hard invariants, both enforced
+// with explicit sorts rather than map iteration order, so every replica
+// computes exactly the same Shards array off the same log, plus one
+// best-effort placement policy:
+//
+//  1. proportionally balanced: group g's quota is
+//     floor(NShards * weight(g) / totalWeight), except for the
+//     NShards - sum(everyone's floor quota) groups with the largest
+//     remainder (NShards*weight(g) mod totalWeight) of that division, which
+//     get one more; weight(g) is sc.weights[g], or 1 if g has none. Equal
+//     weights (the default) reduce this to the plain NShards/groups split.
+//     (Draining groups get zero quota, same as if they had left; brand-new
+//     groups start at zero held so they only land in the "one more" bucket
+//     once every group that would otherwise lose a shard has claimed one.)
+//  2. minimal movement: a shard only moves if its current owner is gone,
+//     draining, or already holds its new quota's worth. A group can never
+//     keep more than min(its current count, its quota) of its own shards,
+//     and that is exactly how many it keeps below, so the total kept is at
+//     its theoretical maximum and the total moved (NShards - kept) is at
+//     its minimum for the quotas picked in (1).
+//  3. placement-aware, best-effort: of the groups with room left under (1),
+//     a freed shard prefers one whose sc.placements zone/rack doesn't match
+//     either neighboring shard's (index-1 and index+1, mod NShards), so a
+//     single zone/rack outage is less likely to take out several adjacent
+//     shards at once. This only ever changes *which* free index a group
+//     gets, never how many it gets, so (1) and (2) stay exact regardless.
+//     It is necessarily best-effort: with one owner per shard, how well
+//     spread the whole cluster ends up is ultimately bounded by how the
+//     groups themselves are distributed across zones, which shard() has no
+//     say in.
+//
 // thread unsafe, need lock.
 func (sc *ShardCtrler) shard() {
 	newConfig := &sc.configs[len(sc.configs) - 1]
 	lastConfig := sc.configs[len(sc.configs) - 2]
-	// need to sort the gids here, image when the number of gids > shards
-	// the smaller gids will have higher priority to be assigned a shard after increasing sort
+
+	// draining groups stay in Groups (so they're still addressable for
+	// migration handoff) but get zero quota, same as if they had left.
 	newGIDs := make([]int, 0)
-	for k, _ := range newConfig.Groups {
+	for k := range newConfig.Groups {
+		if sc.draining[k] {
+			continue
+		}
 		newGIDs = append(newGIDs, k)
- 	}
+	}
 	sort.Ints(newGIDs)
 
-	groups := len(newConfig.Groups)
-	if groups == 0 { // all grouds have been removed
-		return 
-	} 
-	
-	quotient := NShards / groups
-	remainder := NShards % groups
+	groups := len(newGIDs)
+	if groups == 0 { // all groups have been removed or are draining
+		for i := range newConfig.Shards {
+			newConfig.Shards[i] = 0
+		}
+		return
+	}
+
+	if sc.cfg.Mode == PlacementModeConsistentHash {
+		sc.shardConsistentHash(newConfig, newGIDs)
+		DPrintf("%d shard: %v", sc.me, newConfig.Shards)
+		return
+	}
 
-	cnt := map[int]int{} // gip -> num of shards
-	// first, count the groups that exist in both last shards and new config
+	current := map[int]int{} // gid -> shards it holds today, among surviving groups
 	for _, gid := range lastConfig.Shards {
-		if _, ok := newConfig.Groups[gid]; !ok {
-			continue
+		if _, ok := newConfig.Groups[gid]; ok && !sc.draining[gid] {
+			current[gid]++
 		}
-		// only count the gid that hasn't been recorded
-		if _, ok := cnt[gid]; !ok { 
-			if remainder > 0 {
-				cnt[gid] = quotient + 1
-				remainder--
-			} else {
-				cnt[gid] = quotient
-			}
+	}
+
+	totalWeight := 0
+	weight := make(map[int]int, groups)
+	for _, gid := range newGIDs {
+		w := sc.weights[gid]
+		if w <= 0 {
+			w = 1
 		}
+		weight[gid] = w
+		totalWeight += w
 	}
 
-	// second, count the groups that only exist in new config
+	// floorQuota/remainder come from dividing NShards proportionally by
+	// weight (the largest-remainder apportionment method): every remainder
+	// shares the same denominator (totalWeight), so comparing them directly
+	// below is a fair comparison of fractional shares despite the weights
+	// differing.
+	floorQuota := make(map[int]int, groups)
+	remainder := make(map[int]int, groups)
+	assigned := 0
 	for _, gid := range newGIDs {
-		// only count the gid that hasn't been recorded
-		if _, ok := cnt[gid]; !ok { 
-			if remainder > 0 {
-				cnt[gid] = quotient + 1
-				remainder--
-			} else {
-				cnt[gid] = quotient
-			}
+		product := NShards * weight[gid]
+		floorQuota[gid] = product / totalWeight
+		remainder[gid] = product % totalWeight
+		assigned += floorQuota[gid]
+	}
+	extra := NShards - assigned
+
+	// rank the surviving groups by who'd otherwise lose a shard first (same
+	// reasoning as the unweighted case: a +1 only raises what a group keeps
+	// when it already holds more than its floor quota), then by largest
+	// remainder for proportional fairness among the rest, then gid to break
+	// any remaining tie — so invariant (2) holds no matter how "extra"
+	// happens to split.
+	ranked := make([]int, groups)
+	copy(ranked, newGIDs)
+	sort.Slice(ranked, func(i, j int) bool {
+		gi, gj := ranked[i], ranked[j]
+		giGains := current[gi] > floorQuota[gi]
+		gjGains := current[gj] > floorQuota[gj]
+		if giGains != gjGains {
+			return giGains
+		}
+		if remainder[gi] != remainder[gj] {
+			return remainder[gi] > remainder[gj]
+		}
+		return gi < gj
+	})
+
+	quota := make(map[int]int, groups)
+	for i, gid := range ranked {
+		quota[gid] = floorQuota[gid]
+		if i < extra {
+			quota[gid]++
 		}
 	}
 
-	DPrintf("%d cnt: %v", sc.me, cnt)
-	restIndex := make([]int, 0) // record the unassigned index
-	// move as few shards as possible
-	for i, v := range lastConfig.Shards {
-		if n, ok := cnt[v]; ok && n > 0 {  
-			newConfig.Shards[i] = v
-			cnt[v]--
-			if cnt[v] == 0 {
-				delete(cnt, v)
-			}
+	kept := map[int]int{}
+	free := make([]int, 0) // shard indices that need a (possibly new) owner
+	for i, gid := range lastConfig.Shards {
+		if _, ok := newConfig.Groups[gid]; ok && !sc.draining[gid] && kept[gid] < quota[gid] {
+			newConfig.Shards[i] = gid
+			kept[gid]++
 		} else {
-			restIndex = append(restIndex, i)
+			free = append(free, i)
 		}
 	}
-	
-	// since the order of element is undeterministic in map
-	// we need to convert it to a sorted array first
-	restGIDs := make([]int, 0)
-	for k, v := range cnt {
-		for i := 0; i < v; i++ {
-			restGIDs = append(restGIDs, k)
-		}
- 	}
-	sort.Ints(restGIDs)
 
-	// change the shard at unassigned index
-	i := 0
-	for _, gid := range restGIDs {
-		newConfig.Shards[restIndex[i]] = gid
-		i++
+	// hand out the freed shards in ascending index order, each to the
+	// lowest-gid needy group with the fewest zone/rack clashes against its
+	// already-decided neighbors, so which group gets which index is as
+	// deterministic as everything else here.
+	for _, i := range free {
+		left := newConfig.Shards[(i-1+NShards)%NShards]
+		right := newConfig.Shards[(i+1)%NShards]
+		best := -1
+		bestClashes := -1
+		for _, gid := range newGIDs {
+			if kept[gid] >= quota[gid] {
+				continue
+			}
+			clashes := 0
+			if sc.zonesClash(gid, left) {
+				clashes++
+			}
+			if sc.zonesClash(gid, right) {
+				clashes++
+			}
+			if best == -1 || clashes < bestClashes {
+				best = gid
+				bestClashes = clashes
+			}
+		}
+		newConfig.Shards[i] = best
+		kept[best]++
 	}
 	DPrintf("%d shard: %v", sc.me, newConfig.Shards)
 }
 
+// vnodesPerGID is how many points each gid gets on shardConsistentHash's
+// ring. More points smooth out the ring's per-group imbalance at the cost
+// of a bigger sort; with only NShards points to land, there's no amount of
+// smoothing that makes this as exactly balanced as PlacementModeBalanced,
+// only closer.
+const vnodesPerGID = 100
+
+// ringHash hashes s onto shardConsistentHash's ring. It has to be a fixed
+// function of its input and nothing else (no process-local seed) so that
+// every replica, and a replica that restarts, lands the same shard and gid
+// points at the same spots. sha256 rather than a faster checksum because
+// the ring needs full avalanche across its whole 64 bits: s here is always
+// one of a small family of near-identical strings ("shard-0", "shard-1",
+// ...), and a weaker hash can leave their high bits correlated, clumping
+// them all onto the same few ring points instead of spreading them out.
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// shardConsistentHash fills in newConfig.Shards by hashing each of newGIDs'
+// vnodesPerGID virtual points, and each shard index, onto the same ring,
+// then assigning every shard to whichever point is nearest going clockwise.
+// Unlike the PlacementModeBalanced algorithm in shard(), this never looks
+// at lastConfig: the result depends only on newGIDs, so a Join or Leave
+// remaps only the shards that hashed near the gid(s) that changed, and a
+// controller that loses and rebuilds its config history (e.g. by
+// restarting with the same group membership) reproduces the same
+// assignment from scratch.
+func (sc *ShardCtrler) shardConsistentHash(newConfig *Config, newGIDs []int) {
+	type point struct {
+		hash uint64
+		gid  int
+	}
+	ring := make([]point, 0, len(newGIDs)*vnodesPerGID)
+	for _, gid := range newGIDs {
+		for v := 0; v < vnodesPerGID; v++ {
+			ring = append(ring, point{hash: ringHash(fmt.Sprintf("%d-%d", gid, v)), gid: gid})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	for s := 0; s < NShards; s++ {
+		h := ringHash(fmt.Sprintf("shard-%d", s))
+		i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+		if i == len(ring) {
+			i = 0
+		}
+		newConfig.Shards[s] = ring[i].gid
+	}
+}
+
+
+// configGC periodically proposes a "CompactConfigs" Op discarding every
+// Config older than the minimum Num acked (via AckConfig) by every group
+// currently in the latest config's Groups. The cutoff is computed once
+// here by the leader and carried inside the Op, so every replica drops
+// exactly the same prefix of sc.configs instead of each possibly reaching
+// a different answer from its own, potentially stale, view of sc.acked.
+// A group that has never acked counts as needing everything: cutoff stays
+// at its map zero value of 0 until it does, which blocks compaction
+// entirely, the safe default. Only the leader proposes, for the same
+// reason shardkv's dupTableGC is leader-only: followers would just be
+// proposing the same compaction redundantly.
+func (sc *ShardCtrler) configGC() {
+	for {
+		select {
+		case <-time.After(time.Duration(sc.cfg.ConfigGCInterval) * time.Millisecond):
+		case <-sc.done:
+			return
+		}
+
+		if sc.killed() {
+			return
+		}
+		if _, isLeader := sc.rf.GetState(); !isLeader {
+			continue
+		}
+
+		sc.mu.Lock()
+		cutoff := 0
+		first := true
+		for gid := range sc.configs[len(sc.configs)-1].Groups {
+			acked := sc.acked[gid]
+			if first || acked < cutoff {
+				cutoff = acked
+				first = false
+			}
+		}
+		base := sc.configs[0].Num
+		sc.mu.Unlock()
+
+		if cutoff <= base {
+			continue
+		}
+		sc.rf.Start(Op{Type: "CompactConfigs", CompactBefore: cutoff})
+	}
+}
@@ -2,6 +2,8 @@ package shardctrler
 
 import (
 	"fmt"
+	"math/rand"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -401,3 +403,491 @@ func TestMulti(t *testing.T) {
 
 	fmt.Printf("  ... Passed\n")
 }
+
+// test the Drain/WaitForDrain/Leave decommission workflow: Drain should
+// reassign a group's shards while still keeping it in Groups, and it
+// should only disappear from Groups once Decommission calls Leave.
+func TestDecommission(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	fmt.Printf("Test: Decommission ...\n")
+
+	var gid1, gid2 int = 1, 2
+	ck.Join(map[int][]string{gid1: []string{"x", "y", "z"}})
+	ck.Join(map[int][]string{gid2: []string{"a", "b", "c"}})
+	check(t, []int{gid1, gid2}, ck)
+
+	ck.Drain([]int{gid1})
+
+	c := ck.Query(-1)
+	if _, ok := c.Groups[gid1]; !ok {
+		t.Fatalf("Drain should not remove gid %v from Groups", gid1)
+	}
+	for s, g := range c.Shards {
+		if g == gid1 {
+			t.Fatalf("shard %v still assigned to draining gid %v", s, gid1)
+		}
+	}
+
+	// no group has reported itself drained yet, so Decommission should
+	// still be waiting; Leave hasn't happened, so gid1 is still in Groups.
+	ck.ReportDrained(gid1, true)
+	ck.WaitForDrain(gid1)
+	ck.Leave([]int{gid1})
+
+	check(t, []int{gid2}, ck)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// runShard builds a ShardCtrler with just enough state for shard() to run
+// (no raft, no RPCs: shard() only touches sc.configs, sc.draining and
+// sc.weights) and returns the resulting Shards array, without mutating the
+// caller's configs. weights may be nil for the default weight of 1 everywhere.
+func runShard(lastShards [NShards]int, oldGroups map[int][]string, newGroups map[int][]string, weights map[int]int) [NShards]int {
+	sc := &ShardCtrler{draining: map[int]bool{}, weights: weights}
+	if sc.weights == nil {
+		sc.weights = map[int]int{}
+	}
+	last := Config{Num: 0, Shards: lastShards, Groups: oldGroups}
+	next := Config{Num: 1, Groups: newGroups}
+	sc.configs = []Config{last, next}
+	sc.shard()
+	return sc.configs[1].Shards
+}
+
+// minMovesLowerBound brute-forces, over every way the NShards%len(groups)
+// remainder shards could be handed out as quotient+1 instead of quotient,
+// the fewest shards that must move: NShards minus the most a group can ever
+// keep of its own shards under any valid quota split. shard()'s move count
+// should always hit this exactly; see the invariant (2) comment on shard().
+func minMovesLowerBound(current map[int]int, groups []int) int {
+	quotient := NShards / len(groups)
+	remainder := NShards % len(groups)
+	best := -1
+	var pick func(start, remaining int, bonus map[int]bool)
+	pick = func(start, remaining int, bonus map[int]bool) {
+		if remaining == 0 {
+			kept := 0
+			for _, g := range groups {
+				quota := quotient
+				if bonus[g] {
+					quota++
+				}
+				if current[g] < quota {
+					kept += current[g]
+				} else {
+					kept += quota
+				}
+			}
+			if kept > best {
+				best = kept
+			}
+			return
+		}
+		if start >= len(groups) || len(groups)-start < remaining {
+			return
+		}
+		bonus[groups[start]] = true
+		pick(start+1, remaining-1, bonus)
+		delete(bonus, groups[start])
+		pick(start+1, remaining, bonus)
+	}
+	pick(0, remainder, map[int]bool{})
+	return NShards - best
+}
+
+// TestRebalanceMinimalMovement checks shard()'s two invariants directly
+// against random Join/Leave-shaped transitions: the result is balanced
+// (every group within one shard of quotient), and it moves exactly as few
+// shards as minMovesLowerBound proves is possible, never more.
+func TestRebalanceMinimalMovement(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 500; trial++ {
+		oldN := 1 + rng.Intn(6)
+		oldGroups := make(map[int][]string)
+		for g := 1; g <= oldN; g++ {
+			oldGroups[g] = []string{fmt.Sprintf("%da", g)}
+		}
+		var lastShards [NShards]int
+		oldGIDs := make([]int, 0, oldN)
+		for g := range oldGroups {
+			oldGIDs = append(oldGIDs, g)
+		}
+		for i := range lastShards {
+			lastShards[i] = oldGIDs[rng.Intn(len(oldGIDs))]
+		}
+
+		// derive newGroups from oldGroups by dropping and/or adding a few,
+		// keeping at least one group so shard() has something to assign to.
+		newGroups := make(map[int][]string)
+		for g, sa := range oldGroups {
+			if rng.Intn(4) != 0 { // 1-in-4 chance this group leaves
+				newGroups[g] = sa
+			}
+		}
+		for i := 0; i < rng.Intn(3); i++ {
+			g := oldN + 1 + i
+			newGroups[g] = []string{fmt.Sprintf("%da", g)}
+		}
+		if len(newGroups) == 0 {
+			newGroups[oldGIDs[0]] = oldGroups[oldGIDs[0]]
+		}
+
+		newShards := runShard(lastShards, oldGroups, newGroups, nil)
+
+		newGIDs := make([]int, 0, len(newGroups))
+		for g := range newGroups {
+			newGIDs = append(newGIDs, g)
+		}
+
+		counts := map[int]int{}
+		for _, g := range newShards {
+			counts[g]++
+		}
+		quotient := NShards / len(newGIDs)
+		for _, g := range newGIDs {
+			if counts[g] < quotient || counts[g] > quotient+1 {
+				t.Fatalf("trial %d: gid %d has %d shards, quotient %d", trial, g, counts[g], quotient)
+			}
+		}
+
+		current := map[int]int{}
+		for _, g := range lastShards {
+			if _, ok := newGroups[g]; ok {
+				current[g]++
+			}
+		}
+		moves := 0
+		for i, g := range newShards {
+			if g != lastShards[i] {
+				moves++
+			}
+		}
+		if want := minMovesLowerBound(current, newGIDs); moves != want {
+			t.Fatalf("trial %d: shard() moved %d shards, minimum possible is %d (old=%v new=%v)", trial, moves, want, oldGroups, newGroups)
+		}
+	}
+}
+
+// TestRebalanceDeterministic checks that shard() depends only on its
+// inputs, not on map iteration order: feeding it the same transition many
+// times (each a fresh run, so Go's per-process map iteration randomization
+// is actually exercised) must always produce the same Shards array.
+func TestRebalanceDeterministic(t *testing.T) {
+	oldGroups := map[int][]string{1: {"a"}, 2: {"b"}, 3: {"c"}, 4: {"d"}, 5: {"e"}}
+	var lastShards [NShards]int
+	for i := range lastShards {
+		lastShards[i] = (i % 5) + 1
+	}
+	newGroups := map[int][]string{2: {"b"}, 3: {"c"}, 6: {"f"}, 7: {"g"}}
+
+	first := runShard(lastShards, oldGroups, newGroups, nil)
+	for i := 0; i < 50; i++ {
+		got := runShard(lastShards, oldGroups, newGroups, nil)
+		if got != first {
+			t.Fatalf("shard() is not deterministic: run 0 got %v, run %d got %v", first, i, got)
+		}
+	}
+}
+
+// TestRebalanceWeighted checks that shard() gives each group its exact
+// largest-remainder share of NShards (floor(NShards*weight/totalWeight),
+// +1 for whichever groups land in the remainder), for a mix of weights
+// that doesn't divide evenly.
+func TestRebalanceWeighted(t *testing.T) {
+	groups := map[int][]string{1: {"a"}, 2: {"b"}, 3: {"c"}}
+	weights := map[int]int{1: 1, 2: 2, 3: 3} // totalWeight 6: floors are 10*1/6=1, 10*2/6=3, 10*3/6=5 (sum 9)
+	var empty [NShards]int
+
+	got := runShard(empty, map[int][]string{}, groups, weights)
+	counts := map[int]int{}
+	for _, g := range got {
+		counts[g]++
+	}
+	// one shard left over after the floors; gid 1 has the largest remainder
+	// (10*1 mod 6 == 4, vs 2 for gid 2 and 0 for gid 3) so it claims it.
+	want := map[int]int{1: 2, 2: 3, 3: 5}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("weighted shard counts = %v, want %v", counts, want)
+	}
+
+	// doubling everyone's weight changes nothing: only the ratios matter.
+	doubled := map[int]int{1: 2, 2: 4, 3: 6}
+	got2 := runShard(empty, map[int][]string{}, groups, doubled)
+	if got2 != got {
+		t.Fatalf("scaling all weights changed the assignment: %v vs %v", got2, got)
+	}
+}
+
+// TestWeightedJoinProportional exercises JoinWeighted and SetWeight through
+// a real cluster: a group with weight 3 should end up with roughly 3x the
+// shards of one with the default weight 1, and changing weight later should
+// move shards without anyone having to Leave and rejoin.
+func TestWeightedJoinProportional(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	fmt.Printf("Test: Weighted Join is proportional ...\n")
+
+	// weight 1 vs 4 (total 5) divides NShards (10) evenly, so the ratio is
+	// exact with nothing left over to break ties on.
+	var gidLight, gidHeavy int = 1, 2
+	ck.JoinWeighted(map[int][]string{
+		gidLight: {"a"},
+		gidHeavy: {"b"},
+	}, map[int]int{gidHeavy: 4}) // gidLight defaults to weight 1
+
+	c := ck.Query(-1)
+	counts := map[int]int{}
+	for _, g := range c.Shards {
+		counts[g]++
+	}
+	if counts[gidHeavy] != 4*counts[gidLight] {
+		t.Fatalf("gid %v (weight 4) got %v shards, gid %v (weight 1) got %v; want a 4:1 ratio",
+			gidHeavy, counts[gidHeavy], gidLight, counts[gidLight])
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: SetWeight rebalances without Leave/Join ...\n")
+
+	ck.SetWeight(gidLight, 4)
+	ck.SetWeight(gidHeavy, 1)
+
+	c2 := ck.Query(-1)
+	if c2.Num <= c.Num {
+		t.Fatalf("SetWeight should create a new config")
+	}
+	counts2 := map[int]int{}
+	for _, g := range c2.Shards {
+		counts2[g]++
+	}
+	if counts2[gidLight] != 4*counts2[gidHeavy] {
+		t.Fatalf("after swapping weights, gid %v got %v shards, gid %v got %v; want a 4:1 ratio",
+			gidLight, counts2[gidLight], gidHeavy, counts2[gidHeavy])
+	}
+	if _, ok := c2.Groups[gidLight]; !ok {
+		t.Fatalf("SetWeight should not remove gid %v from Groups", gidLight)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// runShardPlaced is runShard plus per-gid Placement metadata.
+func runShardPlaced(lastShards [NShards]int, oldGroups map[int][]string, newGroups map[int][]string, weights map[int]int, placements map[int]Placement) [NShards]int {
+	sc := &ShardCtrler{draining: map[int]bool{}, weights: weights, placements: placements}
+	if sc.weights == nil {
+		sc.weights = map[int]int{}
+	}
+	if sc.placements == nil {
+		sc.placements = map[int]Placement{}
+	}
+	last := Config{Num: 0, Shards: lastShards, Groups: oldGroups}
+	next := Config{Num: 1, Groups: newGroups}
+	sc.configs = []Config{last, next}
+	sc.shard()
+	return sc.configs[1].Shards
+}
+
+// TestRebalancePlacementAvoidsClashes checks that when quotas are even
+// enough to make it possible, shard()'s placement policy keeps adjacent
+// shards off groups in the same zone, instead of the contiguous gid-ordered
+// blocks it would produce with no placement data at all.
+func TestRebalancePlacementAvoidsClashes(t *testing.T) {
+	groups := map[int][]string{1: {"a"}, 2: {"b"}}
+	placements := map[int]Placement{1: {Zone: "z1"}, 2: {Zone: "z2"}}
+	var empty [NShards]int
+
+	unplaced := runShard(empty, map[int][]string{}, groups, nil)
+	clashes := 0
+	for i, g := range unplaced {
+		if unplaced[(i+1)%NShards] == g {
+			clashes++
+		}
+	}
+	if clashes == 0 {
+		t.Fatalf("expected the no-placement baseline to clash somewhere, got none: %v", unplaced)
+	}
+
+	placed := runShardPlaced(empty, map[int][]string{}, groups, nil, placements)
+	for i, g := range placed {
+		next := placed[(i+1)%NShards]
+		if placements[g].Zone == placements[next].Zone {
+			t.Fatalf("shards %d and %d both landed in zone %q: %v", i, (i+1)%NShards, placements[g].Zone, placed)
+		}
+	}
+}
+
+// TestRebalancePlacementKeepsInvariants checks that adding placement
+// metadata to an otherwise-identical transition never changes the balance
+// or the move count: the placement policy only picks among groups that
+// (1) and (2) already decided have room, it never changes how many.
+func TestRebalancePlacementKeepsInvariants(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	zones := []string{"z1", "z2", "z3"}
+	for trial := 0; trial < 200; trial++ {
+		oldN := 2 + rng.Intn(5)
+		oldGroups := make(map[int][]string)
+		placements := make(map[int]Placement)
+		for g := 1; g <= oldN; g++ {
+			oldGroups[g] = []string{fmt.Sprintf("%da", g)}
+			placements[g] = Placement{Zone: zones[rng.Intn(len(zones))]}
+		}
+		var lastShards [NShards]int
+		oldGIDs := make([]int, 0, oldN)
+		for g := range oldGroups {
+			oldGIDs = append(oldGIDs, g)
+		}
+		for i := range lastShards {
+			lastShards[i] = oldGIDs[rng.Intn(len(oldGIDs))]
+		}
+
+		newGroups := make(map[int][]string)
+		for g, sa := range oldGroups {
+			if rng.Intn(4) != 0 {
+				newGroups[g] = sa
+			}
+		}
+		if len(newGroups) == 0 {
+			newGroups[oldGIDs[0]] = oldGroups[oldGIDs[0]]
+		}
+
+		without := runShard(lastShards, oldGroups, newGroups, nil)
+		with := runShardPlaced(lastShards, oldGroups, newGroups, nil, placements)
+
+		countsWithout, countsWith := map[int]int{}, map[int]int{}
+		movesWithout, movesWith := 0, 0
+		for i := range without {
+			countsWithout[without[i]]++
+			countsWith[with[i]]++
+			if without[i] != lastShards[i] {
+				movesWithout++
+			}
+			if with[i] != lastShards[i] {
+				movesWith++
+			}
+		}
+		if !reflect.DeepEqual(countsWithout, countsWith) {
+			t.Fatalf("trial %d: placement changed shard counts: %v vs %v", trial, countsWithout, countsWith)
+		}
+		if movesWithout != movesWith {
+			t.Fatalf("trial %d: placement changed move count: %d vs %d", trial, movesWithout, movesWith)
+		}
+	}
+}
+
+// runShardHashed is runShard but with PlacementModeConsistentHash.
+func runShardHashed(lastShards [NShards]int, oldGroups map[int][]string, newGroups map[int][]string) [NShards]int {
+	sc := &ShardCtrler{draining: map[int]bool{}, cfg: ShardCtrlerConfig{Mode: PlacementModeConsistentHash}}
+	last := Config{Num: 0, Shards: lastShards, Groups: oldGroups}
+	next := Config{Num: 1, Groups: newGroups}
+	sc.configs = []Config{last, next}
+	sc.shard()
+	return sc.configs[1].Shards
+}
+
+// TestConsistentHashStableAcrossRestarts checks the defining property of
+// PlacementModeConsistentHash: the assignment depends only on the current
+// group set, not on lastConfig, so recomputing it from a blank history
+// (as a restarted controller would) reproduces exactly what a controller
+// that walked there incrementally landed on.
+func TestConsistentHashStableAcrossRestarts(t *testing.T) {
+	groups := map[int][]string{1: {"a"}, 2: {"b"}, 3: {"c"}}
+	var empty [NShards]int
+
+	incremental := runShardHashed(empty, map[int][]string{}, map[int][]string{1: {"a"}})
+	incremental = runShardHashed(incremental, map[int][]string{1: {"a"}}, map[int][]string{1: {"a"}, 2: {"b"}})
+	incremental = runShardHashed(incremental, map[int][]string{1: {"a"}, 2: {"b"}}, groups)
+
+	fromScratch := runShardHashed(empty, map[int][]string{}, groups)
+
+	if incremental != fromScratch {
+		t.Fatalf("consistent-hash assignment depended on history: incremental %v, from scratch %v", incremental, fromScratch)
+	}
+}
+
+// TestConsistentHashLocalMovement checks the other defining property:
+// adding one more group only remaps shards that land near its new ring
+// points, leaving the rest where they were, unlike PlacementModeBalanced
+// which can reshuffle quotas across every surviving group.
+func TestConsistentHashLocalMovement(t *testing.T) {
+	oldGroups := map[int][]string{1: {"a"}, 2: {"b"}, 3: {"c"}}
+	before := runShardHashed([NShards]int{}, map[int][]string{}, oldGroups)
+
+	newGroups := map[int][]string{1: {"a"}, 2: {"b"}, 3: {"c"}, 4: {"d"}}
+	after := runShardHashed(before, oldGroups, newGroups)
+
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+			if after[i] != 4 {
+				t.Fatalf("shard %d moved to gid %d, not the new group 4: before %v, after %v", i, after[i], before, after)
+			}
+		}
+	}
+	if moved == 0 || moved == NShards {
+		t.Fatalf("expected some but not all shards to move to the new group, moved %d of %d", moved, NShards)
+	}
+}
+
+// TestConfigCompaction checks ingestCommand's "CompactConfigs" case: it
+// discards every Config older than CompactBefore, but never the newest
+// one, and a later Query for a discarded Num comes back ErrCompacted while
+// a Query for one that survived still works.
+func TestConfigCompaction(t *testing.T) {
+	sc := &ShardCtrler{
+		DupTable: map[int64]DupEntry{},
+		resultCh: map[int]chan doitResult{},
+		draining: map[int]bool{},
+		weights:  map[int]int{},
+		placements: map[int]Placement{},
+		acked:    map[int]int{},
+		configCh: make(chan struct{}),
+	}
+	sc.configs = []Config{{Num: 0, Groups: map[int][]string{}}}
+
+	for i := 1; i <= 5; i++ {
+		sc.ingestCommand(i, Op{Type: "Join", Servers: map[int][]string{i: {"x"}}, ClientId: int64(i), SN: 1})
+	}
+	if len(sc.configs) != 6 {
+		t.Fatalf("expected 6 configs before compaction, got %d", len(sc.configs))
+	}
+
+	sc.ingestCommand(6, Op{Type: "CompactConfigs", CompactBefore: 3})
+
+	if _, ok := sc.configAt(2); ok {
+		t.Fatalf("expected config 2 to be compacted away")
+	}
+	if cfg, ok := sc.configAt(3); !ok || cfg.Num != 3 {
+		t.Fatalf("expected config 3 to survive compaction, got %+v ok=%v", cfg, ok)
+	}
+
+	sc.ingestCommand(7, Op{Type: "Query", Num: 1, ClientId: 100, SN: 1})
+	if got := sc.DupTable[100].Err; got != ErrCompacted {
+		t.Fatalf("Query(1) after compaction = %v, want ErrCompacted", got)
+	}
+
+	sc.ingestCommand(8, Op{Type: "Query", Num: 4, ClientId: 101, SN: 1})
+	if got := sc.DupTable[101]; got.Err != OK || got.Config.Num != 4 {
+		t.Fatalf("Query(4) after compaction = %+v, want Num 4, Err OK", got)
+	}
+
+	// a cutoff past every retained config still leaves the newest one, so
+	// there is always something to answer Query(-1) with.
+	sc.ingestCommand(9, Op{Type: "CompactConfigs", CompactBefore: 1000})
+	if len(sc.configs) != 1 {
+		t.Fatalf("expected exactly the newest config to survive an aggressive compaction, got %d configs", len(sc.configs))
+	}
+	if sc.configs[0].Num != 5 {
+		t.Fatalf("expected the surviving config to be the newest (Num 5), got Num %d", sc.configs[0].Num)
+	}
+}
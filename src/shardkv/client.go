@@ -39,6 +39,24 @@ type Clerk struct {
 	make_end func(string) *labrpc.ClientEnd
 	clientId int64
 	SN int // serial number
+	leaders  map[int]int // gid -> index into Config.Groups[gid] last known to be the leader
+}
+
+// order returns the indices 0..n-1 of a group's server list, starting from
+// the cached last-known leader for gid if there is one, so steady-state
+// operations hit the right server first instead of re-probing from 0 every
+// time. The cache is just a hint: a stale entry costs one extra RPC, same
+// as not having one.
+func (ck *Clerk) order(gid, n int) []int {
+	start := 0
+	if leader, ok := ck.leaders[gid]; ok && leader < n {
+		start = leader
+	}
+	order := make([]int, n)
+	for i := 0; i < n; i++ {
+		order[i] = (start + i) % n
+	}
+	return order
 }
 
 // the tester calls MakeClerk.
@@ -55,6 +73,7 @@ func MakeClerk(ctrlers []*labrpc.ClientEnd, make_end func(string) *labrpc.Client
 	ck.clientId = nrand()
 	ck.config = ck.sm.Query(-1)
 	ck.SN = 0
+	ck.leaders = make(map[int]int)
 	return ck
 }
 
@@ -75,18 +94,25 @@ func (ck *Clerk) Get(key string) string {
 		gid := ck.config.Shards[shard]
 		args.SID = shard
 		if servers, ok := ck.config.Groups[gid]; ok {
-			// try each server for the shard.
-			for si := 0; si < len(servers); si++ {
+			// try each server for the shard, starting from the cached leader.
+			for _, si := range ck.order(gid, len(servers)) {
 				srv := ck.make_end(servers[si])
 				var reply GetReply
 				ok := srv.Call("ShardKV.Get", &args, &reply)
 				if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+					ck.leaders[gid] = si
 					return reply.Value
 				}
-				if ok && (reply.Err == ErrWrongGroup) {
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+				if ok && reply.Err == ErrShardMigrating {
+					// every replica in the group is mid-migration on this
+					// shard together; stop probing the rest and back off
+					// instead of burning the whole server list for nothing.
 					break
 				}
-				// ... not ok, or ErrWrongLeader
+				// ... not ok, ErrWrongLeader, ErrTimeout, or ErrShutdown: try the next server
 			}
 		}
 		time.Sleep(100 * time.Millisecond)
@@ -97,15 +123,62 @@ func (ck *Clerk) Get(key string) string {
 	return ""
 }
 
+// GetStale is like Get, but may be served by any up-to-date replica of the
+// owning group instead of only the leader, at the cost of a bounded risk of
+// missing a very recent write (see ShardKV.GetStale). Useful for read-heavy
+// workloads that want to spread load across a group's replicas.
+func (ck *Clerk) GetStale(key string) string {
+	args := GetArgs{
+		Key:      key,
+		ClientId: ck.clientId,
+		SN:       ck.SN,
+	}
+	ck.SN++
+
+	for {
+		shard := key2shard(key)
+		gid := ck.config.Shards[shard]
+		args.SID = shard
+		if servers, ok := ck.config.Groups[gid]; ok {
+			// unlike Get, try every server even after a reply: any of them
+			// may be able to answer locally, so there is no leader to home
+			// in on and no reason to stop early on ErrWrongLeader.
+			for _, si := range ck.order(gid, len(servers)) {
+				srv := ck.make_end(servers[si])
+				var reply GetReply
+				ok := srv.Call("ShardKV.GetStale", &args, &reply)
+				if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+					return reply.Value
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+				// ... not ok, ErrWrongLeader (no usable lease right now), ErrTimeout,
+				// ErrShardMigrating, or ErrShutdown: try the next replica anyway
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		// ask controler for the latest configuration.
+		ck.config = ck.sm.Query(-1)
+	}
+}
+
 // shared by Put and Append.
 // You will have to modify this function.
 func (ck *Clerk) PutAppend(key string, value string, op string) {
+	ck.putAppend(key, value, op, 0)
+}
+
+// putAppend is shared by PutAppend and the TTL variants below; ttl of 0
+// means the key never expires.
+func (ck *Clerk) putAppend(key string, value string, op string, ttl time.Duration) {
 	args := PutAppendArgs {
-		Key: key, 
-		Value: value, 
-		Op: op, 
-		ClientId: ck.clientId, 
+		Key: key,
+		Value: value,
+		Op: op,
+		ClientId: ck.clientId,
 		SN: ck.SN,
+		TTL: ttl.Milliseconds(),
 	}
 
 	ck.SN++
@@ -114,17 +187,70 @@ func (ck *Clerk) PutAppend(key string, value string, op string) {
 		gid := ck.config.Shards[shard]
 		args.SID = shard
 		if servers, ok := ck.config.Groups[gid]; ok {
-			for si := 0; si < len(servers); si++ {
+			for _, si := range ck.order(gid, len(servers)) {
 				srv := ck.make_end(servers[si])
 				var reply PutAppendReply
 				ok := srv.Call("ShardKV.PutAppend", &args, &reply)
 				if ok && reply.Err == OK {
+					ck.leaders[gid] = si
 					return
 				}
 				if ok && reply.Err == ErrWrongGroup {
 					break
 				}
-				// ... not ok, or ErrWrongLeader
+				if ok && reply.Err == ErrShardMigrating {
+					// every replica in the group is mid-migration on this
+					// shard together; stop probing the rest and back off
+					// instead of burning the whole server list for nothing.
+					break
+				}
+				// ... not ok, ErrWrongLeader, ErrTimeout, or ErrShutdown: try the next server
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		// ask controler for the latest configuration.
+		ck.config = ck.sm.Query(-1)
+	}
+}
+
+// CAS sets key to new only if its current value equals expected (a missing
+// key matches expected == ""), and reports whether the swap happened. On a
+// mismatch it returns the key's actual current value so the caller can
+// retry with a fresh expected without a round trip to fetch it first.
+func (ck *Clerk) CAS(key string, expected string, new string) (bool, string) {
+	args := CASArgs{
+		Key:      key,
+		Expected: expected,
+		New:      new,
+		ClientId: ck.clientId,
+		SN:       ck.SN,
+	}
+	ck.SN++
+
+	for {
+		shard := key2shard(key)
+		gid := ck.config.Shards[shard]
+		args.SID = shard
+		if servers, ok := ck.config.Groups[gid]; ok {
+			for _, si := range ck.order(gid, len(servers)) {
+				srv := ck.make_end(servers[si])
+				var reply CASReply
+				ok := srv.Call("ShardKV.CAS", &args, &reply)
+				if ok && reply.Err == OK {
+					ck.leaders[gid] = si
+					return true, reply.Value
+				}
+				if ok && reply.Err == ErrCASMismatch {
+					ck.leaders[gid] = si
+					return false, reply.Value
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+				if ok && reply.Err == ErrShardMigrating {
+					break
+				}
+				// ... not ok, ErrWrongLeader, ErrTimeout, or ErrShutdown: try the next server
 			}
 		}
 		time.Sleep(100 * time.Millisecond)
@@ -139,3 +265,67 @@ func (ck *Clerk) Put(key string, value string) {
 func (ck *Clerk) Append(key string, value string) {
 	ck.PutAppend(key, value, "Append")
 }
+
+// PutTTL is like Put, but the key expires ttl after this call is applied.
+// A Get for an expired key behaves as if the key was never set.
+func (ck *Clerk) PutTTL(key string, value string, ttl time.Duration) {
+	ck.putAppend(key, value, "Put", ttl)
+}
+
+// AppendTTL is like Append, but (re)sets the key's expiry to ttl after this
+// call is applied, extending it if the key already had one.
+func (ck *Clerk) AppendTTL(key string, value string, ttl time.Duration) {
+	ck.putAppend(key, value, "Append", ttl)
+}
+
+// MiniTxn applies ops atomically: either all of them take effect, as one
+// raft log entry, or (on error) none do. All of ops' keys must fall in the
+// same shard, since a MiniTxn cannot span groups; this panics otherwise
+// rather than silently sending a txn the server would reject anyway.
+func (ck *Clerk) MiniTxn(ops []MiniTxnOp) {
+	if len(ops) == 0 {
+		return
+	}
+	shard := key2shard(ops[0].Key)
+	for _, op := range ops {
+		if key2shard(op.Key) != shard {
+			panic("MiniTxn: keys span more than one shard")
+		}
+	}
+
+	args := MiniTxnArgs{
+		Ops:      ops,
+		ClientId: ck.clientId,
+		SN:       ck.SN,
+		SID:      shard,
+	}
+	ck.SN++
+
+	for {
+		gid := ck.config.Shards[shard]
+		if servers, ok := ck.config.Groups[gid]; ok {
+			for _, si := range ck.order(gid, len(servers)) {
+				srv := ck.make_end(servers[si])
+				var reply MiniTxnReply
+				ok := srv.Call("ShardKV.MiniTxn", &args, &reply)
+				if ok && reply.Err == OK {
+					ck.leaders[gid] = si
+					return
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+				if ok && reply.Err == ErrShardMigrating {
+					// every replica in the group is mid-migration on this
+					// shard together; stop probing the rest and back off
+					// instead of burning the whole server list for nothing.
+					break
+				}
+				// ... not ok, ErrWrongLeader, ErrTimeout, or ErrShutdown: try the next server
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		// ask controler for the latest configuration.
+		ck.config = ck.sm.Query(-1)
+	}
+}
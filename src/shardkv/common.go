@@ -16,17 +16,95 @@ const (
 	ErrWrongLeader = "ErrWrongLeader"
 	ErrOutdatedConfig = "ErrOutdatedConfig"
 	ErrUpdatingConfig = "ErrUpdatingConfig"
+	ErrChecksumMismatch = "ErrChecksumMismatch"
+	ErrCASMismatch = "ErrCASMismatch" // CAS's Expected did not match the key's current value (or absence)
+	ErrTimeout = "ErrTimeout" // doit submitted to raft but got no result within ResponseTimeout; client op's fate is unknown, safe to retry
+	ErrShardMigrating = "ErrShardMigrating" // this group owns the shard but it is mid-migration (in or out), not ready to serve it
+	ErrShutdown = "ErrShutdown" // this server is being killed; try another replica
 	ResponseTimeout = 1000
+	// MigrationResponseTimeout is doit's deadline for migration ops
+	// ("MigrationIn", submitted from ShardMigration) instead of the shorter
+	// ResponseTimeout client ops use: installing a whole shard is one big
+	// raft entry, so it can legitimately take longer to commit than a single
+	// key's Put/Get, and timing it out on the same clock as client ops just
+	// multiplies load by retransmitting a shard that was already on its way in.
+	MigrationResponseTimeout = 5000
+	// BatchWindow is how long kv.batcher lets a composite raft entry sit
+	// open for other concurrently arriving ClientPlayload ops to join
+	// before sending it, trading a little latency for fewer, larger
+	// entries under load.
+	BatchWindow = 5
 	// maxraftstate(1000) equals approximated 16 logs,
 	// so I choose 10 here for avoding confilts.
 	SnapCheckpoint = 10
 
 	PollInterval = 100 // poll the shardctrler to learn about new configurations.
+	ConfigPrefetchDepth = 5 // how many future configs to fetch ahead of the applied one
+	LoadReportInterval = 500 // how often to report per-shard load to the shardctrler
+	DupTableGCInterval = 2000 // how often the leader proposes a DupTable GC pass
+	DupTableTTL = 2000 // raft log entries a DupTable entry may sit idle before it is eligible for GC
+	ExpireInterval = 500 // how often the leader proposes an "Expire" pass over TTL'd keys
 	ShardOK = "ShardOK"
 	ShardMigrationOut = "ShardMigrationOut"
 	ShardMigrationIn = "ShardMigrationIn"
 )
 
+// ShardKVConfig collects the tunables that trade reconfiguration latency
+// and client-op retry aggressiveness against load on the shardctrler and
+// the underlying raft log. StartServer takes an optional ShardKVConfig;
+// DefaultShardKVConfig() is used when none is given, and reproduces the
+// values this package used back when they were plain constants.
+type ShardKVConfig struct {
+	PollInterval             int // ms, how often to poll the shardctrler for new configs
+	ResponseTimeout          int // ms, doit's deadline for an ordinary client op
+	MigrationResponseTimeout int // ms, doit's deadline for a ShardMigration install
+	BatchWindow              int // ms, how long the batcher waits for concurrent ops to join an entry
+	SnapCheckpoint           int // snapshot every this many applied raft entries, if over maxraftstate
+	ConfigPrefetchDepth      int // how many future configs to fetch ahead of the applied one
+	LoadReportInterval       int // ms, how often to report per-shard load/drain status to the shardctrler
+	DupTableGCInterval       int // ms, how often the leader proposes a DupTable GC pass
+	DupTableTTL              int // raft log entries a DupTable entry may sit idle before GC
+	ExpireInterval           int // ms, how often the leader proposes an "Expire" pass over TTL'd keys
+}
+
+// ShardStatsArgs asks the leader for this group's per-shard request counts
+// and byte volumes accumulated since the previous ShardStats call (or
+// since startup, for the first one): a windowed snapshot, not a running
+// total, so an external auto-balancer can compute rates directly from one
+// reply without having to remember the last one.
+type ShardStatsArgs struct {
+}
+
+// ShardStat is one shard's counters for the window ShardStatsReply.WindowMs
+// covers.
+type ShardStat struct {
+	Reads      int64
+	Writes     int64
+	ReadBytes  int64
+	WriteBytes int64
+}
+
+type ShardStatsReply struct {
+	Err      Err
+	WindowMs int64               // how long this window was, the denominator for a rate
+	Shards   map[int]ShardStat   // by SID, only shards this group currently owns
+}
+
+func DefaultShardKVConfig() ShardKVConfig {
+	return ShardKVConfig{
+		PollInterval:             PollInterval,
+		ResponseTimeout:          ResponseTimeout,
+		MigrationResponseTimeout: MigrationResponseTimeout,
+		BatchWindow:              BatchWindow,
+		SnapCheckpoint:           SnapCheckpoint,
+		ConfigPrefetchDepth:      ConfigPrefetchDepth,
+		LoadReportInterval:       LoadReportInterval,
+		DupTableGCInterval:       DupTableGCInterval,
+		DupTableTTL:              DupTableTTL,
+		ExpireInterval:           ExpireInterval,
+	}
+}
+
 type Err string
 type ShardStatus string
 
@@ -39,6 +117,7 @@ type PutAppendArgs struct {
 	ClientId int64
 	SN int
 	SID int
+	TTL int64 // milliseconds until the key expires; 0 means no expiry
 }
 
 type PutAppendReply struct {
@@ -63,10 +142,116 @@ type ShardMigrationArgs struct {
 	SN int
 	SID int
 	Data map[string]string
+	Expiry map[string]int64 // TTL metadata for Data, moves with the shard
 	DupTable map[int64]DupEntry
+	Checksum uint32 // over Data, computed deterministically over sorted keys
 }
 
 type ShardMigrationReply struct {
 	Num int
 	Err Err
+}
+
+// ShardWarmup pulls a read-only copy of a shard the caller does not yet own,
+// so it can be pre-copied before the config switch that makes it the owner.
+// It is also used, right after the switch, for the short final catch-up pull.
+// Unlike ShardMigration it is not replicated: the caller treats the result as
+// a starting point and still installs the shard through the normal
+// "MigrationIn" path once it is the owner.
+type ShardWarmupArgs struct {
+	SID   int
+	Final bool // true for the final catch-up pull: only served once the source has frozen the shard
+}
+
+type ShardWarmupReply struct {
+	Err      Err
+	Data     map[string]string
+	Expiry   map[string]int64 // TTL metadata for Data, moves with the shard
+	DupTable map[int64]DupEntry
+}
+
+// MiniTxnOp is one step of a MiniTxn: a Put, Append, or Delete on a single key.
+type MiniTxnOp struct {
+	Type  string // "Put", "Append" or "Delete"
+	Key   string
+	Value string // empty for "Delete"
+}
+
+// MiniTxn applies Ops atomically in one raft entry. All keys must map to
+// the same shard (SID), checked with key2shard before the RPC is sent and
+// re-checked against the group's current ownership on apply; it cannot
+// span shards or groups, so it needs none of full cross-group 2PC.
+type MiniTxnArgs struct {
+	Ops      []MiniTxnOp
+	ClientId int64
+	SN       int
+	SID      int
+}
+
+type MiniTxnReply struct {
+	Err Err
+}
+
+// Poke is an admin RPC for operators/tests: it wakes this server's
+// pollTrigger and migrationTrigger right away instead of waiting for their
+// normal interval, and reports what it found so a caller can tell whether
+// poking actually had anything to do or the group was already caught up.
+type PokeArgs struct {
+}
+
+type PokeReply struct {
+	Err       Err
+	IsLeader  bool
+	ConfigNum int
+	Migrating bool // true if any owned shard is mid-migration (in or out)
+}
+
+// ExportShard is an admin RPC for offline backup: it snapshots one shard's
+// data, TTL metadata, and dedup table as currently applied by the leader,
+// for writing out to a file/stream. It does not check shard ownership,
+// since an operator may want a backup of a shard mid-migration or one this
+// group no longer actively serves.
+type ExportShardArgs struct {
+	SID int
+}
+
+type ExportShardReply struct {
+	Err       Err
+	ConfigNum int // config this snapshot was taken under, for the operator's records
+	Data      map[string]string
+	Expiry    map[string]int64
+	DupTable  map[int64]DupEntry
+}
+
+// ImportShard installs a previously exported shard into this group,
+// bypassing the normal raft-replicated migration path entirely: for
+// restoring a backup, or for seeding a test environment with
+// production-shaped data. Like a real migration it goes through raft so
+// every replica ends up with the same data, but unlike one it does not
+// check who the shardctrler currently says owns the shard.
+type ImportShardArgs struct {
+	SID      int
+	Data     map[string]string
+	Expiry   map[string]int64
+	DupTable map[int64]DupEntry
+}
+
+type ImportShardReply struct {
+	Err Err
+}
+
+// CASArgs asks the owning group to atomically set Key to New only if its
+// current value equals Expected; a missing key matches Expected == "".
+type CASArgs struct {
+	Key      string
+	Expected string
+	New      string
+	ClientId int64
+	SN       int
+	SID      int
+}
+
+type CASReply struct {
+	Err   Err
+	Value string // current value of Key, whether or not the swap happened
 }
\ No newline at end of file
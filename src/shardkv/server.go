@@ -6,7 +6,10 @@ import (
 	"6.5840/raft"
 	"6.5840/shardctrler"
 	"bytes"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,22 +32,46 @@ type Op struct {
 }
 
 type ClientPlayload struct {
-	Type  string // "Get", "Put" or "Append"
-	Key   string // "Key" for the "Value"
-	Value string // empty for "Get"
+	Type     string // "Put", "Append" or "CAS" (Get is served via ReadIndex, not a log entry)
+	Key      string // "Key" for the "Value"
+	Value    string // new value for "CAS"
+	Expiry   int64  // absolute unix-ms deadline for Put/Append, 0 means no TTL
+	Expected string // "CAS" only: swap only takes effect if Key's current value equals this
 }
 
 type ServerPlayload struct {
-	Type   string             // "MigrationOut", "MigrationIn" or "Config"
+	Type   string             // "MigrationOut", "MigrationIn", "MigrationOutDone", "Config", "GC" or "Expire"
 	Data   map[string]string  // shard data replicated by leader
+	Expiry map[string]int64   // shard TTL metadata, moves alongside Data on migration
 	DupTable map[int64]DupEntry
 	Config shardctrler.Config // newConfig replicated by leader
+	ConfigNum int            // config this migration progress applies to, for "MigrationOutDone"
+	GCBefore int             // lastApplied cutoff for "GC": entries idle before this index are pruned
+	ExpireBefore int64       // unix-ms cutoff for "Expire": keys with an earlier deadline are deleted
+}
+
+// MiniTxnPlayload carries a MiniTxn's Ops through Op.Playload: unlike
+// ClientPlayload it can touch more than one key, but every key must still
+// map to op.SID so it applies as an ordinary single-shard entry.
+type MiniTxnPlayload struct {
+	Ops []MiniTxnOp
+}
+
+// BatchPlayload carries a batch of independent ClientPlayload ops (each
+// still its own Op, with its own ClientId/SN/SID) through a single raft
+// entry, so a burst of concurrent Puts/Appends/CASes across a group costs
+// one log append instead of one each. Every Op in the batch still applies,
+// dedups, and reports its result exactly as if it had gone out alone; see
+// kv.batcher and ShardKV.applyClientOp.
+type BatchPlayload struct {
+	Ops []Op
 }
 
 type DupEntry struct { // record the executed request
-	SN    int
-	Value string
-	Err   Err
+	SN       int
+	Value    string
+	Err      Err
+	LastSeen int // lastApplied index as of this entry's last write, for DupTable GC
 }
 
 type doitResult struct {
@@ -55,9 +82,36 @@ type doitResult struct {
 	Err      Err    // err message
 }
 
+// pendingBatchOp is one ClientPlayload op waiting in kv.pendingBatch for
+// kv.batcher to fold it into the next BatchPlayload entry.
+type pendingBatchOp struct {
+	op       Op
+	resultCh chan doitResult
+}
+
+// shardCounters are the atomically-updated request counts and byte
+// volumes behind the ShardStats RPC; see kv.recordRead/kv.recordWrite.
+type shardCounters struct {
+	reads      int64
+	writes     int64
+	readBytes  int64
+	writeBytes int64
+}
+
 type Shard struct {
-	Status ShardStatus
-	Data   map[string]string
+	Status      ShardStatus
+	Data        map[string]string
+	Expiry      map[string]int64 // key -> absolute unix-ms deadline, only present for TTL'd keys
+	FromGid     int             // gid this shard is migrating in from, valid while status is ShardMigrationIn
+	FromServers []string        // that gid's servers, captured at config-switch time in case it has since left
+}
+
+// a shard copy pulled ahead of ownership, so the eventual MigrationIn only
+// has to paper over whatever changed since the pull instead of starting cold.
+type warmCopy struct {
+	Data     map[string]string
+	Expiry   map[string]int64
+	DupTable map[int64]DupEntry
 }
 
 type ShardKV struct {
@@ -71,6 +125,10 @@ type ShardKV struct {
 	gid          int
 	ctrlers      []*labrpc.ClientEnd
 	maxraftstate int // snapshot if log grows this big
+	shardLoad    [shardctrler.NShards]int64 // requests served per shard since the last report, atomic
+	shardStats   [shardctrler.NShards]shardCounters // per-shard read/write counts and bytes, for ShardStats
+	statsWindowStart time.Time // start of the current ShardStats window, protected by mu
+	cfg          ShardKVConfig               // tunables; see DefaultShardKVConfig
 
 	// Persistent state on snapshot, capitalize for encoding
 	Shards    []Shard              // shard -> data
@@ -80,10 +138,23 @@ type ShardKV struct {
 	// Volatile state on all server.
 	resultCh    map[int]chan doitResult // transfer result to RPC
 	lastApplied int                     // lastApplied log index
+	configCache map[int]shardctrler.Config // configs fetched ahead of the applied one, by Num
+	warmCache   map[int]warmCopy            // pre-copied data for shards this group will soon own, by SID
+
+	pendingBatch []pendingBatchOp        // ClientPlayload ops waiting to go out in the next composite entry
+	batchWaiters map[int][]chan doitResult // raft index of a BatchPlayload entry -> its ops' reply channels, in order
+	batchTrigger chan bool
+
+	applyNotify chan struct{} // closed and replaced every time ingestCommand advances lastApplied
 
 	// Channels
-	pollTrigger      chan bool
-	migrationTrigger chan bool
+	pollTrigger        chan bool
+	migrationTrigger    chan bool
+	migrationInTrigger  chan bool
+	warmupTrigger       chan bool
+
+	done     chan struct{} // closed by Kill(), so blocking background loops wake up and exit
+	doneOnce sync.Once
 }
 
 // the tester calls Kill() when a ShardKV instance won't
@@ -93,6 +164,7 @@ type ShardKV struct {
 func (kv *ShardKV) Kill() {
 	atomic.StoreInt32(&kv.dead, 1)
 	kv.rf.Kill()
+	kv.doneOnce.Do(func() { close(kv.done) })
 }
 
 func (kv *ShardKV) killed() bool {
@@ -126,18 +198,27 @@ func (kv *ShardKV) killed() bool {
 //
 // StartServer() must return quickly, so it should start goroutines
 // for any long-running work.
-func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister, maxraftstate int, gid int, ctrlers []*labrpc.ClientEnd, make_end func(string) *labrpc.ClientEnd) *ShardKV {
+//
+// cfgOverride is optional: pass nothing to get DefaultShardKVConfig(), or
+// one ShardKVConfig to tune reconfiguration latency, op timeouts, etc.
+func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister, maxraftstate int, gid int, ctrlers []*labrpc.ClientEnd, make_end func(string) *labrpc.ClientEnd, cfgOverride ...ShardKVConfig) *ShardKV {
 	// call labgob.Register on structures you want
 	// Go's RPC library to marshall/unmarshall.
 	labgob.Register(Op{})
 	labgob.Register(ClientPlayload{})
 	labgob.Register(ServerPlayload{})
+	labgob.Register(MiniTxnPlayload{})
+	labgob.Register(BatchPlayload{})
 	labgob.Register(shardctrler.Config{})
 	labgob.Register(DupEntry{})
 
 	kv := new(ShardKV)
 	kv.me = me
 	kv.maxraftstate = maxraftstate
+	kv.cfg = DefaultShardKVConfig()
+	if len(cfgOverride) > 0 {
+		kv.cfg = cfgOverride[0]
+	}
 	kv.make_end = make_end
 	kv.gid = gid
 	kv.ctrlers = ctrlers
@@ -146,9 +227,17 @@ func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister,
 	kv.applyCh = make(chan raft.ApplyMsg)
 	kv.pollTrigger = make(chan bool)
 	kv.migrationTrigger = make(chan bool)
-	
+	kv.migrationInTrigger = make(chan bool)
+	kv.warmupTrigger = make(chan bool)
+	kv.batchTrigger = make(chan bool)
+
 	kv.rf = raft.Make(servers, me, persister, kv.applyCh)
 	kv.resultCh = make(map[int]chan doitResult)
+	kv.batchWaiters = make(map[int][]chan doitResult)
+	kv.configCache = make(map[int]shardctrler.Config)
+	kv.warmCache = make(map[int]warmCopy)
+	kv.applyNotify = make(chan struct{})
+	kv.done = make(chan struct{})
 
 	kv.DupTables = make([]map[int64]DupEntry, shardctrler.NShards)
 	for i, _ := range kv.DupTables {
@@ -159,13 +248,25 @@ func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister,
 	for i, _ := range kv.Shards {
 		kv.Shards[i].Status = ShardOK
 		kv.Shards[i].Data = make(map[string]string)
+		kv.Shards[i].Expiry = make(map[string]int64)
 	}
 
+	kv.statsWindowStart = time.Now()
+
 	kv.ingestSnap(persister.ReadSnapshot())
 
 	go kv.applier(kv.applyCh, persister, maxraftstate)
+	go kv.batcher(kv.batchTrigger)
 	go kv.startMigrationOut(kv.migrationTrigger)
+	go kv.startMigrationIn(kv.migrationInTrigger)
 	go kv.pollTicker(kv.pollTrigger)
+	go kv.warmupWorker(kv.warmupTrigger)
+	go kv.loadReporter()
+	go kv.configWatcher(kv.pollTrigger)
+	go kv.dupTableGC()
+	go kv.expireWorker()
+	go kv.drainMonitor()
+	go kv.configAcker()
 
 	signalCh(kv.pollTrigger, true)
 
@@ -177,11 +278,27 @@ func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister,
 // if current server is the leader, it will replicate the log through Raft, and update the key/value pairs based on the Op.
 // finally, it returns response info in Op for next same Op check.
 func (kv *ShardKV) doit(op *Op) doitResult {
+	return kv.doitTimeout(op, time.Duration(kv.cfg.ResponseTimeout)*time.Millisecond)
+}
+
+// doitTimeout is doit with an explicit deadline, so a caller whose op is
+// expected to take longer than an ordinary client op (e.g. ShardMigration
+// installing a whole shard in one entry) doesn't get ErrTimeout and retry
+// while the original is still on its way to committing.
+func (kv *ShardKV) doitTimeout(op *Op, timeout time.Duration) doitResult {
 	result := doitResult{ClientId: op.ClientId, SN: op.SN, SID: op.SID}
 
 	kv.mu.Lock()
 
-	if _, ok := op.Playload.(ClientPlayload); ok {
+	if kv.killed() {
+		result.Err = ErrShutdown
+		kv.mu.Unlock()
+		return result
+	}
+
+	_, isClientOp := op.Playload.(ClientPlayload)
+	_, isMiniTxn := op.Playload.(MiniTxnPlayload)
+	if isClientOp || isMiniTxn {
 		// the follower should have the ability to detect duplicate before redirect to leader.
 		// if it is a up-to-date follower, it is safe to do so.
 		// if it is a stale follower, it is still safe to do so, because:
@@ -200,33 +317,57 @@ func (kv *ShardKV) doit(op *Op) doitResult {
 		}
 
 		// check if the replica group is responsible or ready for this client op
-		if kv.Config.Shards[op.SID] != kv.gid || kv.Shards[op.SID].Status != ShardOK {
+		if kv.Config.Shards[op.SID] != kv.gid {
 			result.Err = ErrWrongGroup
 			kv.mu.Unlock()
 			return result
 		}
+		if kv.Shards[op.SID].Status != ShardOK {
+			// we own the shard, just not yet (or no longer): migration is in
+			// flight, distinct from ErrWrongGroup so the clerk doesn't treat
+			// this the same as talking to the wrong group entirely.
+			result.Err = ErrShardMigrating
+			kv.mu.Unlock()
+			return result
+		}
 
 	}
-	
-	index, _, isLeader := kv.rf.Start(*op)
 
-	if !isLeader { // check if it is leader
-		result.Err = ErrWrongLeader
+	ch := make(chan doitResult)
+	if isClientOp {
+		// queue behind kv.batcher instead of starting our own raft entry:
+		// a burst of concurrent Puts/Appends/CASes across a group then
+		// costs one log append instead of one each. See kv.batcher.
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			result.Err = ErrWrongLeader
+			kv.mu.Unlock()
+			return result
+		}
+		kv.pendingBatch = append(kv.pendingBatch, pendingBatchOp{op: *op, resultCh: ch})
+		if len(kv.pendingBatch) == 1 {
+			signalCh(kv.batchTrigger, true) // first op in the batch starts its window
+		}
 		kv.mu.Unlock()
-		return result
-	}
+	} else {
+		index, _, isLeader := kv.rf.Start(*op)
 
-	DPrintf("(%d:%d) call op: %v at index %d", kv.gid, kv.me, op, index)
+		if !isLeader { // check if it is leader
+			result.Err = ErrWrongLeader
+			kv.mu.Unlock()
+			return result
+		}
 
-	// must create reply channel before unlock
-	ch := make(chan doitResult)
-	kv.resultCh[index] = ch
-	kv.mu.Unlock()
+		DPrintf("(%d:%d) call op: %v at index %d", kv.gid, kv.me, op, index)
+
+		// must create reply channel before unlock
+		kv.resultCh[index] = ch
+		kv.mu.Unlock()
+	}
 
 	select {
 	case result = <-ch:
-	case <-time.After(time.Duration(ResponseTimeout) * time.Millisecond):
-		result.Err = ErrWrongLeader // if we don't get a reponse in time, leader may be dead
+	case <-time.After(timeout):
+		result.Err = ErrTimeout // submitted to raft but no result yet; may still commit, safe to retry
 	}
 
 	go func() { // unblock applier
@@ -236,28 +377,177 @@ func (kv *ShardKV) doit(op *Op) doitResult {
 	return result
 }
 
+// GetStale answers a Get straight out of this replica's own Shards, with no
+// raft log append at all, so any up-to-date replica of the group (not just
+// the leader) can serve it and spread out read load. rf.ReadIndex grants a
+// safe index to read at if this peer is the leader, or a follower whose
+// lease on the current term hasn't expired; GetStale then waits for its own
+// lastApplied to catch up to that index before looking at Shards. This is
+// weaker than Get: a follower's own commitIndex can lag the true cluster
+// commit point by up to a heartbeat round-trip, so a GetStale immediately
+// following a Put of the same key on a different connection can still
+// observe the old value. Use Get when a result must reflect the most
+// recent write; use GetStale for read-heavy workloads that can tolerate
+// that bounded staleness in exchange for not bottlenecking on the leader.
+func (kv *ShardKV) GetStale(args *GetArgs, reply *GetReply) {
+	atomic.AddInt64(&kv.shardLoad[args.SID], 1)
+	defer func() { kv.recordRead(args.SID, len(reply.Value)) }()
+
+	if kv.killed() {
+		reply.Err = ErrShutdown
+		return
+	}
+
+	index, ready := kv.rf.ReadIndex()
+	if !ready {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	deadline := time.Now().Add(time.Duration(kv.cfg.ResponseTimeout) * time.Millisecond)
+	kv.mu.Lock()
+	for kv.lastApplied < index {
+		notify := kv.applyNotify
+		kv.mu.Unlock()
+		select {
+		case <-notify:
+		case <-time.After(time.Until(deadline)):
+			reply.Err = ErrTimeout
+			return
+		}
+		kv.mu.Lock()
+	}
+	defer kv.mu.Unlock()
+
+	sid, key := args.SID, args.Key
+	if kv.Config.Shards[sid] != kv.gid {
+		reply.Err = ErrWrongGroup
+		return
+	}
+	if kv.Shards[sid].Status != ShardOK {
+		reply.Err = ErrShardMigrating
+		return
+	}
+	if deadline, ok := kv.Shards[sid].Expiry[key]; ok && deadline <= time.Now().UnixMilli() {
+		reply.Err = ErrNoKey
+		return
+	}
+	if v, ok := kv.Shards[sid].Data[key]; ok {
+		reply.Value = v
+		reply.Err = OK
+		return
+	}
+	reply.Err = ErrNoKey
+}
+
+// Get reads via raft's ReadIndex instead of appending a log entry for
+// every read, so read traffic no longer competes with writes for log
+// space. Unlike GetStale it only trusts the leader's own commitIndex (no
+// follower lease) and re-confirms the term hasn't changed while it waited
+// for lastApplied to catch up to that index, so it stays linearizable: a
+// leadership change mid-wait can't make it answer with a value that is
+// older than what a client could already have observed elsewhere.
 func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) {
+	atomic.AddInt64(&kv.shardLoad[args.SID], 1)
+	defer func() { kv.recordRead(args.SID, len(reply.Value)) }()
+
+	if kv.killed() {
+		reply.Err = ErrShutdown
+		return
+	}
+
+	term, isLeader := kv.rf.GetState()
+	if !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	index, ready := kv.rf.ReadIndex()
+	if !ready {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	deadline := time.Now().Add(time.Duration(kv.cfg.ResponseTimeout) * time.Millisecond)
+	kv.mu.Lock()
+	for kv.lastApplied < index {
+		notify := kv.applyNotify
+		kv.mu.Unlock()
+		select {
+		case <-notify:
+		case <-time.After(time.Until(deadline)):
+			reply.Err = ErrTimeout
+			return
+		}
+		kv.mu.Lock()
+	}
+	defer kv.mu.Unlock()
+
+	if curTerm, stillLeader := kv.rf.GetState(); !stillLeader || curTerm != term {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	sid, key := args.SID, args.Key
+	if kv.Config.Shards[sid] != kv.gid {
+		reply.Err = ErrWrongGroup
+		return
+	}
+	if kv.Shards[sid].Status != ShardOK {
+		reply.Err = ErrShardMigrating
+		return
+	}
+	if deadline, ok := kv.Shards[sid].Expiry[key]; ok && deadline <= time.Now().UnixMilli() {
+		reply.Err = ErrNoKey
+		return
+	}
+	if v, ok := kv.Shards[sid].Data[key]; ok {
+		reply.Value = v
+		reply.Err = OK
+		return
+	}
+	reply.Err = ErrNoKey
+}
+
+func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
+
+	atomic.AddInt64(&kv.shardLoad[args.SID], 1)
+	kv.recordWrite(args.SID, len(args.Value))
 
 	op := Op{
 		ClientId: args.ClientId,
 		SN:       args.SN,
 		SID:      args.SID,
 	}
+	var expiry int64
+	if args.TTL > 0 {
+		// compute the absolute deadline here, before replication, so every
+		// replica applies the exact same deadline instead of each adding
+		// args.TTL to its own local clock at apply time.
+		expiry = time.Now().Add(time.Duration(args.TTL) * time.Millisecond).UnixMilli()
+	}
 	op.Playload = ClientPlayload{
-		Type: "Get",
-		Key:  args.Key,
+		Type:   args.Op,
+		Key:    args.Key,
+		Value:  args.Value,
+		Expiry: expiry,
 	}
 
 	result := kv.doit(&op)
 
 	// Optimation: reply if it is a same op even though the leader may change
 	if result.SID == args.SID && result.ClientId == args.ClientId && result.SN == args.SN {
-		reply.Value = result.Value
 		reply.Err = result.Err
 	}
 }
 
-func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
+// CAS atomically sets args.Key to args.New if its current value equals
+// args.Expected (a missing key matches Expected == ""), mirroring the CAS
+// primitive applications sharing keys across many writers need, without
+// them having to fake it client-side across ErrWrongGroup retries.
+func (kv *ShardKV) CAS(args *CASArgs, reply *CASReply) {
+
+	atomic.AddInt64(&kv.shardLoad[args.SID], 1)
+	kv.recordWrite(args.SID, len(args.New))
 
 	op := Op{
 		ClientId: args.ClientId,
@@ -265,9 +555,40 @@ func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
 		SID:      args.SID,
 	}
 	op.Playload = ClientPlayload{
-		Type:  args.Op,
-		Key:   args.Key,
-		Value: args.Value,
+		Type:     "CAS",
+		Key:      args.Key,
+		Value:    args.New,
+		Expected: args.Expected,
+	}
+
+	result := kv.doit(&op)
+
+	if result.SID == args.SID && result.ClientId == args.ClientId && result.SN == args.SN {
+		reply.Value = result.Value
+		reply.Err = result.Err
+	}
+}
+
+// MiniTxn applies args.Ops atomically in a single raft entry. All of the
+// Ops' keys must map to args.SID; the clerk checks this before sending, and
+// ingestCommand checks it again at apply time, so a stale clerk can only
+// ever get ErrWrongGroup back, never a partial apply.
+func (kv *ShardKV) MiniTxn(args *MiniTxnArgs, reply *MiniTxnReply) {
+
+	atomic.AddInt64(&kv.shardLoad[args.SID], 1)
+	txnBytes := 0
+	for _, txnOp := range args.Ops {
+		txnBytes += len(txnOp.Value)
+	}
+	kv.recordWrite(args.SID, txnBytes)
+
+	op := Op{
+		ClientId: args.ClientId,
+		SN:       args.SN,
+		SID:      args.SID,
+	}
+	op.Playload = MiniTxnPlayload{
+		Ops: args.Ops,
 	}
 
 	result := kv.doit(&op)
@@ -278,6 +599,134 @@ func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
 	}
 }
 
+// Poke lets an operator or test nudge a wedged server instead of restarting
+// it: it wakes pollTrigger (re-check the shardctrler now) and
+// migrationTrigger (retry any migration this group is the source of right
+// now) without waiting for their normal interval, and reports enough state
+// to tell whether that was useful.
+func (kv *ShardKV) Poke(args *PokeArgs, reply *PokeReply) {
+	_, isLeader := kv.rf.GetState()
+	reply.IsLeader = isLeader
+
+	kv.mu.Lock()
+	reply.ConfigNum = kv.Config.Num
+	reply.Migrating = !kv.allShardsOK()
+	kv.mu.Unlock()
+
+	if isLeader {
+		signalCh(kv.pollTrigger, true)
+		signalCh(kv.migrationTrigger, true)
+		signalCh(kv.migrationInTrigger, true)
+	}
+	reply.Err = OK
+}
+
+// ShardStats reports, for every shard this group currently owns, the
+// request counts and byte volumes recorded since the previous ShardStats
+// call (or since startup), for an external auto-balancer to consume. It
+// is leader-only, read-only, and resets the window on every call, so two
+// balancers polling the same group would each see a fraction of the true
+// traffic; that's expected, not a bug, the tester/operator is assumed to
+// run at most one.
+func (kv *ShardKV) ShardStats(args *ShardStatsArgs, reply *ShardStatsReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	kv.mu.Lock()
+	now := time.Now()
+	reply.WindowMs = now.Sub(kv.statsWindowStart).Milliseconds()
+	kv.statsWindowStart = now
+	owned := make(map[int]bool, shardctrler.NShards)
+	for sid, gid := range kv.Config.Shards {
+		if gid == kv.gid {
+			owned[sid] = true
+		}
+	}
+	kv.mu.Unlock()
+
+	reply.Shards = make(map[int]ShardStat)
+	for sid := 0; sid < shardctrler.NShards; sid++ {
+		stat := ShardStat{
+			Reads:      atomic.SwapInt64(&kv.shardStats[sid].reads, 0),
+			Writes:     atomic.SwapInt64(&kv.shardStats[sid].writes, 0),
+			ReadBytes:  atomic.SwapInt64(&kv.shardStats[sid].readBytes, 0),
+			WriteBytes: atomic.SwapInt64(&kv.shardStats[sid].writeBytes, 0),
+		}
+		if owned[sid] {
+			reply.Shards[sid] = stat
+		}
+	}
+	reply.Err = OK
+}
+
+// applyClientOp applies one ClientPlayload op against the already-locked
+// committed state and returns its result, including the dedup check and
+// DupTable update. It is shared by the single-op ClientPlayload case and
+// the BatchPlayload case in ingestCommand below, since a batched op needs
+// exactly the same semantics as one that went out in its own entry. kv.mu
+// must be held by the caller.
+func (kv *ShardKV) applyClientOp(index int, clientId int64, sn int, sid int, pl ClientPlayload) doitResult {
+	result := doitResult{ClientId: clientId, SN: sn, SID: sid, Err: OK}
+
+	if dEntry, ok := kv.DupTables[sid][clientId]; ok && dEntry.SN >= sn {
+		// it is safe to ignore the lower SN request, since the sender has
+		// received the result for this SN, and has sent the higher SN for
+		// another request.
+		if dEntry.SN == sn {
+			result.Err = dEntry.Err
+			result.Value = dEntry.Value
+		}
+	} else { // new request
+		if kv.Config.Shards[sid] != kv.gid || kv.Shards[sid].Status != ShardOK {
+			result.Err = ErrWrongGroup
+			DPrintf("(%d:%d) dangerous request: %v/%v", kv.gid, kv.me, clientId, sn)
+			return result
+		}
+		switch pl.Type {
+		case "Put":
+			kv.Shards[sid].Data[pl.Key] = pl.Value
+			if pl.Expiry > 0 {
+				kv.Shards[sid].Expiry[pl.Key] = pl.Expiry
+			} else {
+				delete(kv.Shards[sid].Expiry, pl.Key) // a plain Put replaces any earlier TTL
+			}
+		case "Append":
+			kv.Shards[sid].Data[pl.Key] += pl.Value
+			if pl.Expiry > 0 {
+				kv.Shards[sid].Expiry[pl.Key] = pl.Expiry // refresh/extend the deadline
+			}
+		case "CAS":
+			// compare against the state as it stands when this entry
+			// applies, not when the clerk sent it, so concurrent CAS
+			// attempts from different clients serialize correctly.
+			deadline, hasExpiry := kv.Shards[sid].Expiry[pl.Key]
+			current, ok := kv.Shards[sid].Data[pl.Key]
+			if hasExpiry && deadline <= time.Now().UnixMilli() {
+				current, ok = "", false
+			}
+			result.Value = current
+			if (ok && current == pl.Expected) || (!ok && pl.Expected == "") {
+				kv.Shards[sid].Data[pl.Key] = pl.Value
+				delete(kv.Shards[sid].Expiry, pl.Key)
+				result.Value = pl.Value
+			} else {
+				result.Err = ErrCASMismatch
+			}
+		default:
+			panic(pl)
+		}
+	}
+	kv.DupTables[sid][clientId] = DupEntry{
+		SN:       result.SN,
+		Value:    result.Value,
+		Err:      result.Err,
+		LastSeen: index,
+	}
+	return result
+}
+
 // ingest one command, and update the state of storage.
 // transfer back the result by OpCh.
 func (kv *ShardKV) ingestCommand(index int, command interface{}) {
@@ -288,18 +737,28 @@ func (kv *ShardKV) ingestCommand(index int, command interface{}) {
 	defer kv.mu.Unlock()
 
 	kv.lastApplied = index // update lastApplied index
+	close(kv.applyNotify)  // wake any Get waiting on readLocal to catch up to this index
+	kv.applyNotify = make(chan struct{})
 
 	switch pl := op.Playload.(type) {
 	case ClientPlayload:
-		// if a duplicate request arrives before the original executes
-		// don't execute if table says already seen
+		result = kv.applyClientOp(index, op.ClientId, op.SN, op.SID, pl)
+	case BatchPlayload:
+		chans, hasWaiters := kv.batchWaiters[index]
+		for i, subOp := range pl.Ops {
+			r := kv.applyClientOp(index, subOp.ClientId, subOp.SN, subOp.SID, subOp.Playload.(ClientPlayload))
+			if hasWaiters {
+				chans[i] <- r
+			}
+		}
+		if hasWaiters {
+			delete(kv.batchWaiters, index)
+		}
+		return // each op already delivered its own result above
+	case MiniTxnPlayload:
 		if dEntry, ok := kv.DupTables[op.SID][op.ClientId]; ok && dEntry.SN >= op.SN {
-			// it is safe to ignore the lower SN request,
-			// since the sender has received the result for this SN,
-			// and has sent the higher SN for another request.
 			if dEntry.SN == op.SN {
 				result.Err = dEntry.Err
-				result.Value = dEntry.Value
 			}
 		} else { // new request
 			if kv.Config.Shards[op.SID] != kv.gid || kv.Shards[op.SID].Status != ShardOK {
@@ -310,27 +769,41 @@ func (kv *ShardKV) ingestCommand(index int, command interface{}) {
 				}
 				DPrintf("(%d:%d) dangerous request: %v", kv.gid, kv.me, op)
 				return
-			} 
-			switch pl.Type {
-			case "Get":
-				value, ok := kv.Shards[op.SID].Data[pl.Key]
-				if ok {
-					result.Value = value
-				} else {
-					result.Err = ErrNoKey
+			}
+			// re-check every key against op.SID: the clerk already did this
+			// before sending, but the leader that proposed this entry may
+			// since have lost the shard, so this is the only check that
+			// actually runs against the config in effect when it applies.
+			wrongShard := false
+			for _, txnOp := range pl.Ops {
+				if key2shard(txnOp.Key) != op.SID {
+					wrongShard = true
+					break
+				}
+			}
+			if wrongShard {
+				result.Err = ErrWrongGroup
+			} else {
+				for _, txnOp := range pl.Ops {
+					switch txnOp.Type {
+					case "Put":
+						kv.Shards[op.SID].Data[txnOp.Key] = txnOp.Value
+						delete(kv.Shards[op.SID].Expiry, txnOp.Key)
+					case "Append":
+						kv.Shards[op.SID].Data[txnOp.Key] += txnOp.Value
+					case "Delete":
+						delete(kv.Shards[op.SID].Data, txnOp.Key)
+						delete(kv.Shards[op.SID].Expiry, txnOp.Key)
+					default:
+						panic(op)
+					}
 				}
-			case "Put":
-				kv.Shards[op.SID].Data[pl.Key] = pl.Value
-			case "Append":
-				kv.Shards[op.SID].Data[pl.Key] += pl.Value
-			default:
-				panic(op)
 			}
 		}
 		kv.DupTables[op.SID][result.ClientId] = DupEntry{
-			SN:    result.SN,
-			Value: result.Value,
-			Err:   result.Err,
+			SN:       result.SN,
+			Err:      result.Err,
+			LastSeen: index,
 		}
 	case ServerPlayload:
 		switch pl.Type {
@@ -344,16 +817,70 @@ func (kv *ShardKV) ingestCommand(index int, command interface{}) {
 		case "MigrationOut":
 			signalCh(kv.migrationTrigger, true)
 			return // no need to record duplication
+		case "MigrationOutDone":
+			// only mark the shard as migrated if it is still the config this send was for;
+			// otherwise a new leader resuming migration would clobber a newer config's state.
+			if pl.ConfigNum == kv.Config.Num && kv.Shards[op.SID].Status == ShardMigrationOut {
+				kv.Shards[op.SID].Status = ShardOK
+				// the destination confirmed receipt, so this group has no
+				// further use for its copy: drop it now instead of carrying
+				// it, unread, into every snapshot until the shard happens to
+				// migrate back in.
+				kv.Shards[op.SID].Data = make(map[string]string)
+				kv.Shards[op.SID].Expiry = make(map[string]int64)
+				DPrintf("(%d:%d) %d migration out done for config %d", kv.gid, kv.me, op.SID, pl.ConfigNum)
+			}
+			if kv.allShardsOK() { // all shards are ok, try if there is any new config
+				signalCh(kv.pollTrigger, true)
+			}
+			return // no need to record duplication
 		case "MigrationIn":
-			if kv.Shards[op.SID].Status == ShardMigrationIn {
-				kv.DupTables[op.SID] = copyOfDupTalbe(pl.DupTable)
+			// also require pl.ConfigNum to match: without it, a slow duplicate
+			// push left over from an earlier migration into this same shard
+			// could still be "for the right status" (ShardMigrationIn) yet be
+			// stale data from a different source group's config.
+			if kv.Shards[op.SID].Status == ShardMigrationIn && pl.ConfigNum == kv.Config.Num {
+				// the donor's LastSeen values are indices into its own raft log,
+				// meaningless here; restamp against this log so the GC cutoff
+				// doesn't immediately treat freshly-migrated entries as stale.
+				kv.DupTables[op.SID] = restampDupTable(pl.DupTable, index)
 				kv.Shards[op.SID].Data = copyOfData(pl.Data)
+				kv.Shards[op.SID].Expiry = copyOfExpiry(pl.Expiry)
 				kv.Shards[op.SID].Status = ShardOK
 				DPrintf("(%d:%d) install %d migration: %v", kv.gid, kv.me, op.SID, op)
 			}
 			if kv.allShardsOK() { // all shards are ok, try if there is any new config
 				signalCh(kv.pollTrigger, true)
 			}
+		case "GC":
+			for sid := range kv.DupTables {
+				for clientId, e := range kv.DupTables[sid] {
+					if e.LastSeen < pl.GCBefore {
+						delete(kv.DupTables[sid], clientId)
+					}
+				}
+			}
+			return // no need to record duplication
+		case "Expire":
+			for sid := range kv.Shards {
+				for key, deadline := range kv.Shards[sid].Expiry {
+					if deadline < pl.ExpireBefore {
+						delete(kv.Shards[sid].Data, key)
+						delete(kv.Shards[sid].Expiry, key)
+					}
+				}
+			}
+			return // no need to record duplication
+		case "Import":
+			// deliberately skips the ownership/status checks "MigrationIn" has:
+			// ImportShard is an explicit operator action, not something the
+			// normal config-driven migration flow should ever produce.
+			kv.DupTables[op.SID] = restampDupTable(pl.DupTable, index)
+			kv.Shards[op.SID].Data = copyOfData(pl.Data)
+			kv.Shards[op.SID].Expiry = copyOfExpiry(pl.Expiry)
+			kv.Shards[op.SID].Status = ShardOK
+			DPrintf("(%d:%d) imported shard %d: %v", kv.gid, kv.me, op.SID, op)
+			return // no need to record duplication
 		default:
 			panic(op)
 		}
@@ -391,9 +918,13 @@ func (kv *ShardKV) applyConfig(newConfig shardctrler.Config) bool {
 		}
 		if newConfig.Shards[i] == kv.gid && kv.Config.Shards[i] != 0 { // halt the shards that need to migrate in
 			kv.Shards[i].Status = ShardMigrationIn
+			kv.Shards[i].FromGid = kv.Config.Shards[i]
+			kv.Shards[i].FromServers = kv.Config.Groups[kv.Config.Shards[i]]
+			signalCh(kv.migrationInTrigger, true)
 		}
 	}
 	kv.Config = newConfig
+	signalCh(kv.warmupTrigger, true) // a new config may reveal shards to pre-copy ahead of the next switch
 	return needMigration
 }
 
@@ -433,7 +964,7 @@ func (kv *ShardKV) applier(applyCh chan raft.ApplyMsg, persister *raft.Persister
 			DPrintf("(%d:%d) apply command: %v at %d", kv.gid, kv.me, m.Command, m.CommandIndex)
 			kv.ingestCommand(m.CommandIndex, m.Command)
 
-			if maxraftstate != -1 && (m.CommandIndex%SnapCheckpoint == 0) {
+			if maxraftstate != -1 && (m.CommandIndex%kv.cfg.SnapCheckpoint == 0) {
 				if persister.RaftStateSize() > maxraftstate {
 					w := new(bytes.Buffer)
 					e := labgob.NewEncoder(w)
@@ -455,18 +986,69 @@ func (kv *ShardKV) applier(applyCh chan raft.ApplyMsg, persister *raft.Persister
 	}
 }
 
+// batcher folds kv.pendingBatch into a single BatchPlayload raft entry at
+// a time, instead of doitTimeout starting one entry per ClientPlayload op.
+// It wakes as soon as a batch has its first op (via batchTrigger), then
+// waits out BatchWindow so anything else arriving in that short window
+// joins the same entry, before finally calling rf.Start once for all of
+// them. ingestCommand demuxes the single committed entry's result back to
+// each op's own waiter via kv.batchWaiters.
+func (kv *ShardKV) batcher(batchTrigger chan bool) {
+	for {
+		select {
+		case <-batchTrigger:
+		case <-kv.done:
+			return
+		}
+
+		select {
+		case <-time.After(time.Duration(kv.cfg.BatchWindow) * time.Millisecond):
+		case <-kv.done:
+			return
+		}
+
+		kv.mu.Lock()
+		if kv.killed() || len(kv.pendingBatch) == 0 {
+			kv.mu.Unlock()
+			continue
+		}
+		batch := kv.pendingBatch
+		kv.pendingBatch = nil
+
+		ops := make([]Op, len(batch))
+		chans := make([]chan doitResult, len(batch))
+		for i, b := range batch {
+			ops[i] = b.op
+			chans[i] = b.resultCh
+		}
+
+		index, _, isLeader := kv.rf.Start(Op{Playload: BatchPlayload{Ops: ops}})
+		if !isLeader {
+			kv.mu.Unlock()
+			for i, ch := range chans {
+				ch <- doitResult{ClientId: ops[i].ClientId, SN: ops[i].SN, SID: ops[i].SID, Err: ErrWrongLeader}
+			}
+			continue
+		}
+		kv.batchWaiters[index] = chans
+		kv.mu.Unlock()
+	}
+}
+
 func (kv *ShardKV) pollTicker(pollTrigger chan bool) {
-	for !kv.killed() {
+	for {
 
 		select {
 		case <-pollTrigger:
-		case <-time.After(time.Duration(PollInterval) * time.Millisecond):
+		case <-time.After(time.Duration(kv.cfg.PollInterval) * time.Millisecond):
+		case <-kv.done:
+			return
 		}
 
 		if kv.killed() {
 			return
 		}
-		
+
 		kv.mu.Lock()
 		DPrintf("(%d:%d) enter poll ticker", kv.gid, kv.me)
 		// can not directly trigger migration here, since some logs may haven't been executed
@@ -475,10 +1057,24 @@ func (kv *ShardKV) pollTicker(pollTrigger chan bool) {
 			kv.mu.Unlock()
 			continue
 		}
+		curNum := kv.Config.Num
+		kv.mu.Unlock()
 
-		// process re-configurations one at a time, in order.
-		newConfig := kv.sm.Query(kv.Config.Num + 1)
+		// eagerly fetch a window of configs beyond the one currently applied, so
+		// catching up across many missed configs costs one round of parallel-ish
+		// queries instead of one round trip per config.
+		kv.prefetchConfigs(curNum)
+
+		// process re-configurations one at a time, in order, regardless of
+		// how many configs are already sitting in the cache.
+		kv.mu.Lock()
+		newConfig, cached := kv.configCache[kv.Config.Num+1]
+		kv.mu.Unlock()
+		if !cached {
+			newConfig = kv.sm.Query(kv.Config.Num + 1)
+		}
 
+		kv.mu.Lock()
 		if kv.Config.Num == newConfig.Num || !kv.allShardsOK() { // same config or shards are not ready
 			kv.mu.Unlock()
 			continue
@@ -497,6 +1093,227 @@ func (kv *ShardKV) pollTicker(pollTrigger chan bool) {
 	}
 }
 
+// configWatcher long-polls the shardctrler for the next config beyond the
+// one currently applied, and wakes pollTicker as soon as one shows up. This
+// is what actually cuts reconfiguration latency and idle Query traffic:
+// pollTicker's own PollInterval timer is still there as a fallback in case
+// the shardctrler can't be reached, but normally this goroutine preempts it.
+func (kv *ShardKV) configWatcher(pollTrigger chan bool) {
+	for {
+		select {
+		case <-kv.done:
+			return
+		default:
+		}
+
+		kv.mu.Lock()
+		curNum := kv.Config.Num
+		kv.mu.Unlock()
+
+		// WaitForConfig is a synchronous RPC with no cancellation of its own
+		// (like labrpc's Call in sendShardMigration below), so this can still
+		// block past Kill() until it returns; the kv.done check above and the
+		// kv.killed() check below bound that to one outstanding call.
+		newConfig := kv.sm.WaitForConfig(curNum)
+
+		if kv.killed() {
+			return
+		}
+		if newConfig.Num > curNum {
+			signalCh(pollTrigger, true)
+		} else {
+			select {
+			case <-time.After(time.Duration(kv.cfg.PollInterval) * time.Millisecond):
+			case <-kv.done:
+				return
+			}
+		}
+	}
+}
+
+// fetch configs ahead of curNum into configCache, up to ConfigPrefetchDepth,
+// stopping at the shardctrler's current frontier. applyConfig still consumes
+// them strictly in order, one at a time; this only hides query latency.
+// QueryRange fetches the whole window in one round trip instead of one
+// Query per missing number.
+func (kv *ShardKV) prefetchConfigs(curNum int) {
+	kv.mu.Lock()
+	for n := range kv.configCache { // drop anything at or behind the applied config
+		if n <= curNum {
+			delete(kv.configCache, n)
+		}
+	}
+	kv.mu.Unlock()
+
+	configs := kv.sm.QueryRange(curNum+1, curNum+kv.cfg.ConfigPrefetchDepth)
+
+	kv.mu.Lock()
+	for _, cfg := range configs {
+		kv.configCache[cfg.Num] = cfg
+	}
+	kv.mu.Unlock()
+}
+
+// loadReporter periodically hands the shardctrler this group's per-shard
+// request counts, so rebalancing can eventually account for skew instead of
+// only shard counts. Only the leader reports, since followers would just be
+// echoing the same load under a different vote.
+func (kv *ShardKV) loadReporter() {
+	for {
+		select {
+		case <-time.After(time.Duration(kv.cfg.LoadReportInterval) * time.Millisecond):
+		case <-kv.done:
+			return
+		}
+
+		if kv.killed() {
+			return
+		}
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			continue
+		}
+
+		var loads [shardctrler.NShards]int
+		for i := range loads {
+			loads[i] = int(atomic.SwapInt64(&kv.shardLoad[i], 0))
+		}
+		kv.sm.ReportLoad(kv.gid, loads)
+	}
+}
+
+// dupTableGC periodically proposes pruning DupTable entries that have sat
+// idle for longer than DupTableTTL raft log entries: clients that have
+// moved on to other keys, been decommissioned, or had their shard migrated
+// away and never come back to this group. The cutoff is computed once by
+// the leader and carried inside the "GC" Op, so every replica deletes
+// exactly the same entries in the same log position instead of each
+// computing its own (possibly different) cutoff from local clock drift.
+func (kv *ShardKV) dupTableGC() {
+	for {
+		select {
+		case <-time.After(time.Duration(kv.cfg.DupTableGCInterval) * time.Millisecond):
+		case <-kv.done:
+			return
+		}
+
+		if kv.killed() {
+			return
+		}
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			continue
+		}
+
+		kv.mu.Lock()
+		cutoff := kv.lastApplied - kv.cfg.DupTableTTL
+		kv.mu.Unlock()
+		if cutoff <= 0 {
+			continue
+		}
+
+		op := Op{}
+		op.Playload = ServerPlayload{
+			Type:     "GC",
+			GCBefore: cutoff,
+		}
+		kv.rf.Start(op)
+	}
+}
+
+// expireWorker periodically proposes an "Expire" Op carrying a single
+// unix-ms cutoff, so TTL'd keys whose deadline has passed get deleted from
+// the replicated Data/Expiry maps in lockstep on every replica, instead of
+// each server expiring them independently at a slightly different time.
+// Get already hides expired-but-not-yet-collected keys on its own, so the
+// only thing this buys is reclaiming space.
+func (kv *ShardKV) expireWorker() {
+	for {
+		select {
+		case <-time.After(time.Duration(kv.cfg.ExpireInterval) * time.Millisecond):
+		case <-kv.done:
+			return
+		}
+
+		if kv.killed() {
+			return
+		}
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			continue
+		}
+
+		op := Op{}
+		op.Playload = ServerPlayload{
+			Type:         "Expire",
+			ExpireBefore: time.Now().UnixMilli(),
+		}
+		kv.rf.Start(op)
+	}
+}
+
+// drainMonitor periodically tells the shardctrler whether this group
+// currently owns no shards and has nothing left mid-migration, which is
+// what Clerk.WaitForDrain on the controller side waits for as part of a
+// Decommission. Only the leader reports, for the same reason loadReporter
+// is leader-only: followers would just be echoing a stale view.
+func (kv *ShardKV) drainMonitor() {
+	for {
+		select {
+		case <-time.After(time.Duration(kv.cfg.LoadReportInterval) * time.Millisecond):
+		case <-kv.done:
+			return
+		}
+
+		if kv.killed() {
+			return
+		}
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			continue
+		}
+
+		kv.mu.Lock()
+		ownsNothing := true
+		for _, gid := range kv.Config.Shards {
+			if gid == kv.gid {
+				ownsNothing = false
+				break
+			}
+		}
+		drained := ownsNothing && kv.allShardsOK()
+		kv.mu.Unlock()
+
+		kv.sm.ReportDrained(kv.gid, drained)
+	}
+}
+
+// configAcker periodically tells the shardctrler the oldest Config this
+// group might still need, so its config history compaction knows it's
+// safe to discard anything older: kv.Config.Num itself, since prefetchConfigs
+// only ever asks the controller for configs strictly newer than the one
+// this group has applied (see applyConfig), and FromServers is captured
+// locally at config-switch time rather than re-queried later. Only the
+// leader reports, for the same reason loadReporter is leader-only.
+func (kv *ShardKV) configAcker() {
+	for {
+		select {
+		case <-time.After(time.Duration(kv.cfg.LoadReportInterval) * time.Millisecond):
+		case <-kv.done:
+			return
+		}
+
+		if kv.killed() {
+			return
+		}
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			continue
+		}
+
+		kv.mu.Lock()
+		num := kv.Config.Num
+		kv.mu.Unlock()
+
+		kv.sm.AckConfig(kv.gid, num)
+	}
+}
+
 func (kv *ShardKV) ShardMigration(args *ShardMigrationArgs, reply *ShardMigrationReply) {
 
 	kv.mu.Lock()
@@ -514,32 +1331,260 @@ func (kv *ShardKV) ShardMigration(args *ShardMigrationArgs, reply *ShardMigratio
 		kv.mu.Unlock()
 		return
 	}
-	
+
 	kv.mu.Unlock()
 
+	if shardChecksum(args.Data) != args.Checksum {
+		DPrintf("(%d:%d) migration checksum mismatch for shard %d, asking for re-transfer", kv.gid, kv.me, args.SID)
+		reply.Err = ErrChecksumMismatch
+		return
+	}
+
 	op := Op{
 		ClientId: args.ClientId,
 		SN:       args.SN,
 		SID:      args.SID,
 	}
 	op.Playload = ServerPlayload{
-		Type: "MigrationIn",
-		Data: args.Data,
-		DupTable: args.DupTable,
+		Type:      "MigrationIn",
+		Data:      args.Data,
+		Expiry:    args.Expiry,
+		DupTable:  args.DupTable,
+		ConfigNum: args.Num,
 	}
-	DPrintf("(%d:%d) receive migration op:%v", kv.gid, kv.me, op)
-	result := kv.doit(&op)
+	entrySize := shardByteSize(args.Data)
+	if kv.maxraftstate != -1 && entrySize > kv.maxraftstate {
+		// this single entry alone is bigger than the snapshot threshold: it
+		// will commit fine, but expect the very next snapshot check to fire
+		// immediately afterward.
+		DPrintf("(%d:%d) migration entry for shard %d is %d bytes, over maxraftstate %d", kv.gid, kv.me, args.SID, entrySize, kv.maxraftstate)
+	}
+	DPrintf("(%d:%d) receive migration op:%v (%d bytes)", kv.gid, kv.me, op, entrySize)
+	result := kv.doitTimeout(&op, time.Duration(kv.cfg.MigrationResponseTimeout)*time.Millisecond)
 	// Optimation: reply if it is a same op even though the leader may change
 	if result.SID == args.SID && result.ClientId == args.ClientId && result.SN == args.SN {
 		reply.Err = result.Err
 	}
 }
 
+// ExportShard snapshots a shard's data, TTL metadata, and dedup table as
+// currently applied by the leader, for an operator to write out for backup.
+// Like ShardWarmup it never mutates state and is not itself replicated.
+func (kv *ShardKV) ExportShard(args *ExportShardArgs, reply *ExportShardReply) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	reply.ConfigNum = kv.Config.Num
+	reply.Data = copyOfData(kv.Shards[args.SID].Data)
+	reply.Expiry = copyOfExpiry(kv.Shards[args.SID].Expiry)
+	reply.DupTable = copyOfDupTalbe(kv.DupTables[args.SID])
+	reply.Err = OK
+}
+
+// ImportShard installs a previously exported (or otherwise produced) shard
+// into this group through raft, bypassing the ownership/status checks the
+// normal "MigrationIn" path relies on, for restoring a backup or seeding a
+// test environment. Overwrites whatever the shard currently holds.
+func (kv *ShardKV) ImportShard(args *ImportShardArgs, reply *ImportShardReply) {
+	op := Op{SID: args.SID}
+	op.Playload = ServerPlayload{
+		Type:     "Import",
+		Data:     args.Data,
+		Expiry:   args.Expiry,
+		DupTable: args.DupTable,
+	}
+	kv.mu.Lock()
+	if kv.killed() {
+		kv.mu.Unlock()
+		reply.Err = ErrShutdown
+		return
+	}
+	kv.mu.Unlock()
+	if _, _, isLeader := kv.rf.Start(op); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	reply.Err = OK
+}
+
+// ShardWarmup serves a read-only copy of a shard this group still owns,
+// for a peer to pre-copy ahead of a config switch or to pull a final
+// catch-up copy right after one. It never mutates state and is not
+// replicated: the result is only ever installed through the normal
+// raft-replicated "MigrationIn" path.
+func (kv *ShardKV) ShardWarmup(args *ShardWarmupArgs, reply *ShardWarmupReply) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	// only the leader is trusted to be caught up with the latest committed
+	// writes; a follower could still be behind on applying them even if its
+	// Config and shard status already look current.
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	// serve while we still hold authoritative data for the shard, i.e. we are
+	// its owner and not ourselves mid-way through receiving it.
+	if kv.Config.Shards[args.SID] != kv.gid || kv.Shards[args.SID].Status == ShardMigrationIn {
+		reply.Err = ErrWrongGroup
+		return
+	}
+	if args.Final && kv.Shards[args.SID].Status == ShardOK {
+		// we have not frozen the shard for migration yet, so this would not
+		// be a safe final copy: more writes may still land on it.
+		reply.Err = ErrUpdatingConfig
+		return
+	}
+	reply.Data = copyOfData(kv.Shards[args.SID].Data)
+	reply.Expiry = copyOfExpiry(kv.Shards[args.SID].Expiry)
+	reply.DupTable = copyOfDupTalbe(kv.DupTables[args.SID])
+	reply.Err = OK
+}
+
+// warmupWorker pre-copies shards this group is about to own, using the
+// already-prefetched next config, while the current owner is still serving
+// the shard normally. This moves the bulk of the data transfer off the
+// critical path of the eventual config switch.
+func (kv *ShardKV) warmupWorker(warmupTrigger chan bool) {
+	for {
+		select {
+		case <-warmupTrigger:
+		case <-time.After(time.Duration(kv.cfg.PollInterval) * time.Millisecond):
+		case <-kv.done:
+			return
+		}
+
+		if kv.killed() {
+			return
+		}
+
+		kv.mu.Lock()
+		nextConfig, haveNext := kv.configCache[kv.Config.Num+1]
+		curConfig := kv.Config
+		for sid := range kv.warmCache { // drop pre-copies that are no longer useful
+			if curConfig.Shards[sid] == kv.gid {
+				delete(kv.warmCache, sid)
+			}
+		}
+		kv.mu.Unlock()
+
+		if !haveNext {
+			continue
+		}
+
+		for i := 0; i < shardctrler.NShards; i++ {
+			if curConfig.Shards[i] == kv.gid || nextConfig.Shards[i] != kv.gid || curConfig.Shards[i] == 0 {
+				continue // already own it, still won't own it, or no owner to copy from yet
+			}
+			kv.mu.Lock()
+			_, cached := kv.warmCache[i]
+			kv.mu.Unlock()
+			if cached {
+				continue
+			}
+			go kv.pullShardCopy(i, curConfig.Groups[curConfig.Shards[i]], true, 0)
+		}
+	}
+}
+
+// startMigrationIn actively pulls the final copy of shards this group has
+// just become the owner of, instead of only waiting passively for the old
+// owner's push, so the handover does not have to wait out a poll interval.
+func (kv *ShardKV) startMigrationIn(migrationInTrigger chan bool) {
+	for {
+		select {
+		case <-migrationInTrigger:
+		case <-kv.done:
+			return
+		}
+
+		if kv.killed() {
+			return
+		}
+
+		kv.mu.Lock()
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			kv.mu.Unlock()
+			continue
+		}
+		configNum := kv.Config.Num
+		for i, shard := range kv.Shards {
+			if shard.Status == ShardMigrationIn {
+				go kv.pullShardCopy(i, shard.FromServers, false, configNum)
+			}
+		}
+		kv.mu.Unlock()
+	}
+}
+
+// pullShardCopy fetches shard sid from one of servers via ShardWarmup. When
+// warmup is true the result is only cached for later use and the call gives
+// up after one pass, since a pre-copy is purely opportunistic. Otherwise it
+// is the final catch-up pull: the source only hands back a copy once it has
+// frozen the shard against further writes, so this retries until that
+// happens (or until another path, e.g. the source's own push, finishes the
+// migration first). configNum is ignored when warmup is true, and otherwise
+// tags the eventual "MigrationIn" so a stale copy can't be installed once
+// the group has moved on to a later config.
+func (kv *ShardKV) pullShardCopy(sid int, servers []string, warmup bool, configNum int) {
+	args := ShardWarmupArgs{SID: sid, Final: !warmup}
+	for {
+		for _, s := range servers {
+			srv := kv.make_end(s)
+			var reply ShardWarmupReply
+			ok := srv.Call("ShardKV.ShardWarmup", &args, &reply)
+			if !ok || reply.Err != OK {
+				continue
+			}
+			if warmup {
+				kv.mu.Lock()
+				kv.warmCache[sid] = warmCopy{Data: reply.Data, Expiry: reply.Expiry, DupTable: reply.DupTable}
+				kv.mu.Unlock()
+				return
+			}
+			op := Op{SID: sid}
+			op.Playload = ServerPlayload{
+				Type:      "MigrationIn",
+				Data:      reply.Data,
+				Expiry:    reply.Expiry,
+				DupTable:  reply.DupTable,
+				ConfigNum: configNum,
+			}
+			kv.doit(&op)
+			return
+		}
+
+		if warmup || kv.killed() {
+			return
+		}
+		kv.mu.Lock()
+		stillPending := kv.Shards[sid].Status == ShardMigrationIn
+		kv.mu.Unlock()
+		if !stillPending {
+			return // already installed, e.g. by the source's own push
+		}
+		time.Sleep(time.Duration(kv.cfg.PollInterval) * time.Millisecond)
+	}
+}
+
 func (kv *ShardKV) startMigrationOut(migrationTrigger chan bool) {
 
-	for !kv.killed() {
+	for {
+		select {
+		case <-migrationTrigger:
+		case <-kv.done:
+			return
+		}
 
-		<-migrationTrigger
+		if kv.killed() {
+			return
+		}
 
 		kv.mu.Lock()
 
@@ -552,13 +1597,16 @@ func (kv *ShardKV) startMigrationOut(migrationTrigger chan bool) {
 			if shard.Status == ShardMigrationOut {
 				gid := kv.Config.Shards[i]
 				servers := kv.Config.Groups[gid]
+				data := copyOfData(kv.Shards[i].Data)
 				args := ShardMigrationArgs{
 					Num:      kv.Config.Num,
 					SID:      i,
 					ClientId: int64(kv.gid),
 					SN:       kv.Config.Num, // use config Num as Serial number here
-					Data:     copyOfData(kv.Shards[i].Data),
+					Data:     data,
+					Expiry:   copyOfExpiry(kv.Shards[i].Expiry),
 					DupTable: copyOfDupTalbe(kv.DupTables[i]),
+					Checksum: shardChecksum(data),
 				}
 				go kv.sendShardMigration(servers, &args, &ShardMigrationReply{})
 			}
@@ -571,28 +1619,34 @@ func (kv *ShardKV) sendShardMigration(servers []string, args *ShardMigrationArgs
 
 	DPrintf("(%d:%d) send migration with args: %v", kv.gid, kv.me, args)
 	for si := 0; si < len(servers); si++ {
+		if kv.killed() {
+			// labrpc's Call has no cancellation of its own, so an attempt
+			// already in flight still runs to completion; this only stops
+			// us from starting another one once Kill() has been called.
+			return
+		}
 		srv := kv.make_end(servers[si])
 		ok := srv.Call("ShardKV.ShardMigration", args, reply)
 		DPrintf("(%d:%d) get reply: %v args: %v", kv.gid, kv.me, reply, args)
-		if ok && (reply.Err == OK) {
-			kv.mu.Lock()
-			if kv.Config.Num == args.Num {
-				kv.Shards[args.SID].Status = ShardOK
-			}
-			kv.mu.Unlock()
-			break
-		}
-		if ok && reply.Err == ErrOutdatedConfig {
-			kv.mu.Lock()
-			if kv.Config.Num == args.Num {
-				kv.Shards[args.SID].Status = ShardOK
-			}
-			kv.mu.Unlock()
+		if ok && (reply.Err == OK || reply.Err == ErrOutdatedConfig) {
+			kv.markMigrationOutDone(args.SID, args.Num)
 			break
 		}
 	}
 }
 
+// replicate the fact that shard SID has finished migrating out of config configNum,
+// so a new leader that takes over mid-migration resumes from this point instead of
+// re-deriving (and possibly re-sending) everything from scratch.
+func (kv *ShardKV) markMigrationOutDone(sid int, configNum int) {
+	op := Op{SID: sid}
+	op.Playload = ServerPlayload{
+		Type:      "MigrationOutDone",
+		ConfigNum: configNum,
+	}
+	kv.rf.Start(op)
+}
+
 func signalCh(ch chan bool, val bool) {
 	select {
 	case ch <- val:
@@ -608,6 +1662,14 @@ func copyOfData(data map[string]string) map[string]string {
 	return result
 }
 
+func copyOfExpiry(expiry map[string]int64) map[string]int64 {
+	result := make(map[string]int64)
+	for k, v := range expiry {
+		result[k] = v
+	}
+	return result
+}
+
 func copyOfDupTalbe(dupTable map[int64]DupEntry) map[int64]DupEntry {
 	result := make(map[int64]DupEntry)
 	for k, v := range dupTable {
@@ -616,6 +1678,60 @@ func copyOfDupTalbe(dupTable map[int64]DupEntry) map[int64]DupEntry {
 	return result
 }
 
+// restampDupTable copies dupTable with LastSeen overwritten to index, for
+// installing a table migrated in from another group's unrelated log space.
+func restampDupTable(dupTable map[int64]DupEntry, index int) map[int64]DupEntry {
+	result := make(map[int64]DupEntry)
+	for k, v := range dupTable {
+		v.LastSeen = index
+		result[k] = v
+	}
+	return result
+}
+
+// recordRead and recordWrite feed the ShardStats RPC: each client-facing
+// handler below calls one of these once, so ShardStats can report
+// time-windowed per-shard request counts and byte volumes to an external
+// auto-balancer without having to instrument the apply path itself.
+func (kv *ShardKV) recordRead(sid int, bytes int) {
+	atomic.AddInt64(&kv.shardStats[sid].reads, 1)
+	atomic.AddInt64(&kv.shardStats[sid].readBytes, int64(bytes))
+}
+
+func (kv *ShardKV) recordWrite(sid int, bytes int) {
+	atomic.AddInt64(&kv.shardStats[sid].writes, 1)
+	atomic.AddInt64(&kv.shardStats[sid].writeBytes, int64(bytes))
+}
+
+// shardByteSize estimates how many bytes a shard's data will cost as a
+// raft log entry (keys plus values; gob and RPC framing add some more on
+// top, but this is close enough to flag an unusually large migration entry).
+func shardByteSize(data map[string]string) int {
+	size := 0
+	for k, v := range data {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// shardChecksum hashes a shard's data deterministically, independent of the
+// map's iteration order, so it can be compared across a gob encode/decode
+// round trip. Keys are sorted first, then each key/value pair is written to
+// the hasher with a length prefix so "ab","c" can't collide with "a","bc".
+func shardChecksum(data map[string]string) uint32 {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New32a()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%d:%s=%d:%s;", len(k), k, len(data[k]), data[k])
+	}
+	return h.Sum32()
+}
+
 // check if all shards are OK
 // thread-unsafe, need lock
 func (kv *ShardKV) allShardsOK() bool {
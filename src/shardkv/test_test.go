@@ -92,6 +92,149 @@ func TestStaticShards(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+// test that PutTTL/AppendTTL keys expire, survive a migration to another
+// group, and that a plain Put clears a previously set TTL.
+func TestTTL(t *testing.T) {
+	fmt.Printf("Test: TTL keys ...\n")
+
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	ck.PutTTL("short", "v1", 200*time.Millisecond)
+	ck.Put("long", "v2")
+	check(t, ck, "short", "v1")
+	check(t, ck, "long", "v2")
+
+	time.Sleep(1 * time.Second)
+
+	if v := ck.Get("short"); v != "" {
+		t.Fatalf("Get(short): expected expired key to read back empty, got %v\n", v)
+	}
+	check(t, ck, "long", "v2")
+
+	// a TTL'd key should keep expiring correctly after its shard moves.
+	ck.PutTTL("moves", "v3", 200*time.Millisecond)
+	cfg.join(1)
+	cfg.leave(0)
+	time.Sleep(1 * time.Second)
+	if v := ck.Get("moves"); v != "" {
+		t.Fatalf("Get(moves): expected expired key to read back empty after migration, got %v\n", v)
+	}
+
+	// a plain Put should clear any earlier TTL.
+	ck.PutTTL("cleared", "v4", 200*time.Millisecond)
+	ck.Put("cleared", "v5")
+	time.Sleep(1 * time.Second)
+	check(t, ck, "cleared", "v5")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMiniTxn(t *testing.T) {
+	fmt.Printf("Test: MiniTxn atomic multi-key ops ...\n")
+
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	// "a0" and "a1" share a shard (same first byte), so this is a valid,
+	// single-shard MiniTxn.
+	ck.MiniTxn([]MiniTxnOp{
+		{Type: "Put", Key: "a0", Value: "v0"},
+		{Type: "Put", Key: "a1", Value: "v1"},
+	})
+	check(t, ck, "a0", "v0")
+	check(t, ck, "a1", "v1")
+
+	ck.MiniTxn([]MiniTxnOp{
+		{Type: "Append", Key: "a0", Value: "-more"},
+		{Type: "Delete", Key: "a1"},
+	})
+	check(t, ck, "a0", "v0-more")
+	check(t, ck, "a1", "")
+
+	// a MiniTxn should keep applying correctly after its shard moves.
+	cfg.join(1)
+	cfg.leave(0)
+	ck.MiniTxn([]MiniTxnOp{
+		{Type: "Put", Key: "a0", Value: "v2"},
+		{Type: "Put", Key: "a1", Value: "v3"},
+	})
+	check(t, ck, "a0", "v2")
+	check(t, ck, "a1", "v3")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestGetStale(t *testing.T) {
+	fmt.Printf("Test: GetStale served by any replica ...\n")
+
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	ck.Put("k", "v1")
+	time.Sleep(300 * time.Millisecond) // give every replica a chance to catch up
+
+	if v := ck.GetStale("k"); v != "v1" {
+		t.Fatalf("GetStale(k): expected v1, got %v\n", v)
+	}
+	if v := ck.GetStale("missing"); v != "" {
+		t.Fatalf("GetStale(missing): expected empty, got %v\n", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCAS(t *testing.T) {
+	fmt.Printf("Test: CAS ...\n")
+
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	// key doesn't exist yet: CAS against expected == "" should succeed.
+	if ok, v := ck.CAS("x", "", "v1"); !ok || v != "v1" {
+		t.Fatalf("CAS(x, \"\", v1): expected ok=true v=v1, got ok=%v v=%v\n", ok, v)
+	}
+	check(t, ck, "x", "v1")
+
+	// wrong expected value: should fail and report the actual current value.
+	if ok, v := ck.CAS("x", "wrong", "v2"); ok || v != "v1" {
+		t.Fatalf("CAS(x, wrong, v2): expected ok=false v=v1, got ok=%v v=%v\n", ok, v)
+	}
+	check(t, ck, "x", "v1")
+
+	// correct expected value: should succeed.
+	if ok, v := ck.CAS("x", "v1", "v2"); !ok || v != "v2" {
+		t.Fatalf("CAS(x, v1, v2): expected ok=true v=v2, got ok=%v v=%v\n", ok, v)
+	}
+	check(t, ck, "x", "v2")
+
+	// CAS should keep applying correctly after its shard moves.
+	cfg.join(1)
+	cfg.leave(0)
+	if ok, v := ck.CAS("x", "v2", "v3"); !ok || v != "v3" {
+		t.Fatalf("CAS(x, v2, v3) after migration: expected ok=true v=v3, got ok=%v v=%v\n", ok, v)
+	}
+	check(t, ck, "x", "v3")
+
+	fmt.Printf("  ... Passed\n")
+}
+
 func TestJoinLeave(t *testing.T) {
 	fmt.Printf("Test: join then leave ...\n")
 